@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	ACK_FEATURE    = "ack"
+	ACK_REASON_MAX = 64
+)
+
+// CommandError is returned by handlers to report a specific errno back to
+// the kernel alongside a human readable reason.
+type CommandError struct {
+	Errno  syscall.Errno
+	Reason string
+}
+
+func (e *CommandError) Error() string {
+	return e.Reason
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Errno
+}
+
+func CommandErrorf(errno syscall.Errno, format string, args ...interface{}) error {
+	return &CommandError{Errno: errno, Reason: fmt.Sprintf(format, args...)}
+}
+
+/* Ack is the reply to every kernel command once the kernel has announced
+ * the "ack" feature in its hello. On the wire it is the string:
+ *
+ *   ack <seq> <cmd> <errno> <reason>
+ *
+ * where seq is the nlmsg_seq of the request and errno is 0 on success.
+ */
+type Ack struct {
+	Seq    uint32
+	Cmd    string
+	Errno  syscall.Errno
+	Reason string
+}
+
+func NewAck(cmd *NetlinkCmd, err error) (ack *Ack) {
+	ack = new(Ack)
+	ack.Seq = cmd.Seq
+	ack.Cmd = cmd.Cmd
+	if err == nil {
+		ack.Reason = "ok"
+		return
+	}
+	ack.Errno = ErrnoOf(err)
+	ack.Reason = err.Error()
+	if len(ack.Reason) > ACK_REASON_MAX {
+		ack.Reason = ack.Reason[:ACK_REASON_MAX]
+	}
+	return
+}
+
+func (ack *Ack) String() string {
+	return fmt.Sprintf("ack %d %s %d %s", ack.Seq, ack.Cmd, int(ack.Errno), strings.TrimSpace(ack.Reason))
+}
+
+// ErrnoOf picks the errno that best describes err. Errors from writes into
+// cgroup files carry the kernel's errno (ESRCH for a dead pid, ...).
+func ErrnoOf(err error) syscall.Errno {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return syscall.ENOENT
+	}
+	return syscall.EIO
+}
+
+// SendAck replies to cmd with the outcome of its handler if the kernel
+// understands acknowledgements.
+func SendAck(sender *NetlinkSender, cmd *NetlinkCmd, err error) error {
+	if !PeerCaps.Supports(ACK_FEATURE) {
+		return nil
+	}
+	return sender.SendString(NewAck(cmd, err).String())
+}
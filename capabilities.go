@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	DAEMON_PROTOCOL_VERSION = NETLINK_PROTOCOL_V2
+)
+
+// Commands understood by kernel patches that predate the handshake
+var LegacyCommands = []string{"mpdecision", "move_to_cgroup", "cpuset"}
+
+/* Capabilities holds what the kernel announced in its reply to our hello.
+ * The daemon sends:
+ *
+ *   hello <version> <cmd>,<cmd>,...
+ *
+ * and the kernel answers with a "hello" command whose args are:
+ *
+ *   <version> <capability>,<capability>,...
+ *
+ * Until a reply arrives we assume a legacy kernel that only knows
+ * LegacyCommands.
+ */
+type Capabilities struct {
+	mutex      sync.RWMutex
+	Negotiated bool
+	Version    uint32
+	Features   map[string]bool
+}
+
+var PeerCaps = NewCapabilities()
+
+func NewCapabilities() (caps *Capabilities) {
+	caps = new(Capabilities)
+	caps.Version = NETLINK_PROTOCOL_V1
+	caps.Features = make(map[string]bool)
+	for _, cmd := range LegacyCommands {
+		caps.Features[cmd] = true
+	}
+	return
+}
+
+func (caps *Capabilities) Supports(feature string) bool {
+	caps.mutex.RLock()
+	defer caps.mutex.RUnlock()
+	return caps.Features[feature]
+}
+
+func (caps *Capabilities) IsNegotiated() bool {
+	caps.mutex.RLock()
+	defer caps.mutex.RUnlock()
+	return caps.Negotiated
+}
+
+// ProtocolVersion returns the version both sides agreed on
+func (caps *Capabilities) ProtocolVersion() uint32 {
+	caps.mutex.RLock()
+	defer caps.mutex.RUnlock()
+	return caps.Version
+}
+
+// Update replaces the capabilities with those announced in a hello
+// reply: the version and the comma separated features, if any
+func (caps *Capabilities) Update(version int, list string) (err error) {
+	if version < 0 || uint64(version) > math.MaxUint32 {
+		return fmt.Errorf("Invalid version in hello reply: %d", version)
+	}
+
+	features := make(map[string]bool)
+	for _, feature := range strings.Split(list, ",") {
+		if feature != "" {
+			features[feature] = true
+		}
+	}
+
+	caps.mutex.Lock()
+	defer caps.mutex.Unlock()
+	caps.Negotiated = true
+	caps.Version = uint32(version)
+	if caps.Version > DAEMON_PROTOCOL_VERSION {
+		caps.Version = DAEMON_PROTOCOL_VERSION
+	}
+	caps.Features = features
+	return
+}
+
+func (caps *Capabilities) String() string {
+	caps.mutex.RLock()
+	defer caps.mutex.RUnlock()
+	features := make([]string, 0, len(caps.Features))
+	for feature := range caps.Features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return fmt.Sprintf("negotiated=%v version=%d features=%s", caps.Negotiated, caps.Version, strings.Join(features, ","))
+}
+
+// HelloMessage announces our version and the commands we handle
+func HelloMessage(commands []string) string {
+	sorted := append([]string(nil), commands...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("hello %d %s", DAEMON_PROTOCOL_VERSION, strings.Join(sorted, ","))
+}
+
+// HelloHandler stores the capabilities from the kernel's hello reply
+func HelloHandler(sender *NetlinkSender, cmd *NetlinkCmd, args *Args) (err error) {
+	if err = PeerCaps.Update(args.Int("version"), args.String("features")); err != nil {
+		log("Failed to parse kernel capabilities:", err)
+		return CommandErrorf(syscall.EINVAL, "%v", err)
+	}
+	log("Kernel capabilities:", PeerCaps.String())
+	return
+}
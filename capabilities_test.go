@@ -0,0 +1,56 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestHelloHandler(t *testing.T) {
+	oldCaps := PeerCaps
+	t.Cleanup(func() { PeerCaps = oldCaps })
+	hello := &Command{Name: "hello", Schema: []ArgSpec{
+		{Name: "version", Type: ARG_INT},
+		{Name: "features", Type: ARG_STRING, Optional: true},
+	}, Handler: HelloHandler}
+
+	tests := []struct {
+		args     string
+		version  uint32
+		features []string
+		errno    syscall.Errno
+	}{
+		{"2 ack,resync", NETLINK_PROTOCOL_V2, []string{ACK_FEATURE, RESYNC_FEATURE}, 0},
+		{"1", NETLINK_PROTOCOL_V1, nil, 0},
+		{"99 ack", DAEMON_PROTOCOL_VERSION, []string{ACK_FEATURE}, 0},
+		{"-1", NETLINK_PROTOCOL_V1, nil, syscall.EINVAL},
+	}
+	for _, test := range tests {
+		PeerCaps = NewCapabilities()
+		args, err := hello.Parse(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := &NetlinkCmd{Cmd: "hello", Args: test.args}
+		err = hello.Handler(nil, cmd, args)
+		if (err == nil) != (test.errno == 0) || (err != nil && ErrnoOf(err) != test.errno) {
+			t.Fatalf("hello %s: %v, want errno %d", test.args, err, test.errno)
+		}
+		if err != nil {
+			if PeerCaps.IsNegotiated() {
+				t.Errorf("hello %s: negotiated", test.args)
+			}
+			continue
+		}
+		if PeerCaps.ProtocolVersion() != test.version {
+			t.Errorf("hello %s: version %d, want %d", test.args, PeerCaps.ProtocolVersion(), test.version)
+		}
+		for _, feature := range test.features {
+			if !PeerCaps.Supports(feature) {
+				t.Errorf("hello %s: %s not supported", test.args, feature)
+			}
+		}
+		if test.features == nil && PeerCaps.Supports(ACK_FEATURE) {
+			t.Errorf("hello %s: legacy features kept", test.args)
+		}
+	}
+}
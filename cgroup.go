@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CGROUP_AUTO = "auto"
+	CGROUP_V1   = "v1"
+	CGROUP_V2   = "v2"
+
+	CGROUP_PROCS   = "cgroup.procs"
+	CGROUP_THREADS = "cgroup.threads"
+	CGROUP_TYPE    = "cgroup.type"
+	CPU_WEIGHT     = "cpu.weight"
+	CPU_SHARES     = "cpu.shares"
+)
+
+var CgroupVersions = []string{CGROUP_AUTO, CGROUP_V1, CGROUP_V2}
+
+/* CgroupBackend maps the daemon's cgroups and cpusets onto the mounted
+ * cgroup hierarchies.
+ *
+ * With cgroup v1 cpu control and cpusets are separate hierarchies: the
+ * cgroup "bg" is /dev/cpuctl/bg and its cpuset "cs_bg" is
+ * /sys/fs/cgroup/cpuset/cs_bg. With cgroup v2 both are the same directory of
+ * the unified hierarchy, so "bg" and "cs_bg" name the same cgroup.
+ */
+type CgroupBackend interface {
+	Version() string
+	// CgroupTasks is the file a tid is written to to join a cpu cgroup
+	CgroupTasks(cgroup string) string
+	// Cpuset is the directory of a cpuset
+	Cpuset(cpuset string) string
+	// CpusetFile is a control file of a cpuset, e.g. cpuset.cpus
+	CpusetFile(cpuset string, file string) string
+	// CpusetTasks is the file a tid is written to to join a cpuset
+	CpusetTasks(cpuset string) string
+	// SeparateCpusets reports whether cpusets are a hierarchy of their
+	// own, so that tasks join a cpuset apart from their cpu cgroup
+	SeparateCpusets() bool
+}
+
+var Cgroups CgroupBackend = CgroupV1{}
+
+type CgroupV1 struct{}
+
+func (CgroupV1) Version() string {
+	return CGROUP_V1
+}
+
+func (CgroupV1) CgroupTasks(cgroup string) string {
+	return Settings.Paths.CgroupTasks(cgroup)
+}
+
+func (CgroupV1) Cpuset(cpuset string) string {
+	return Settings.Paths.Cpuset(cpuset)
+}
+
+func (CgroupV1) CpusetFile(cpuset string, file string) string {
+	return Settings.Paths.CpusetFile(cpuset, file)
+}
+
+func (CgroupV1) CpusetTasks(cpuset string) string {
+	return Settings.Paths.CpusetFile(cpuset, CPUSET_TASKS)
+}
+
+func (CgroupV1) SeparateCpusets() bool {
+	return true
+}
+
+type CgroupV2 struct{}
+
+func (CgroupV2) Version() string {
+	return CGROUP_V2
+}
+
+// dir is the unified cgroup for a cgroup or cpuset name
+func (CgroupV2) dir(name string) string {
+	layout := &Settings.Paths
+	if name == CPUSET_DEFAULT || name == "" {
+		return layout.resolve(layout.Cgroup2Dir)
+	}
+	return layout.resolve(layout.Cgroup2Dir, strings.TrimPrefix(name, CPUSET_PREFIX))
+}
+
+// threadsFile picks cgroup.threads in threaded cgroups, where threads of a
+// process may be spread out, and cgroup.procs otherwise
+func (CgroupV2) threadsFile(dir string) string {
+	if b, err := Fs.ReadFile(filepath.Join(dir, CGROUP_TYPE)); err == nil && strings.TrimSpace(string(b)) == "threaded" {
+		return filepath.Join(dir, CGROUP_THREADS)
+	}
+	return filepath.Join(dir, CGROUP_PROCS)
+}
+
+func (v2 CgroupV2) CgroupTasks(cgroup string) string {
+	return v2.threadsFile(v2.dir(cgroup))
+}
+
+func (v2 CgroupV2) Cpuset(cpuset string) string {
+	return v2.dir(cpuset)
+}
+
+func (v2 CgroupV2) CpusetFile(cpuset string, file string) string {
+	return filepath.Join(v2.dir(cpuset), file)
+}
+
+func (v2 CgroupV2) CpusetTasks(cpuset string) string {
+	return v2.threadsFile(v2.dir(cpuset))
+}
+
+func (CgroupV2) SeparateCpusets() bool {
+	return false
+}
+
+type mountEntry struct {
+	Path    string
+	FsType  string
+	Options []string
+}
+
+func (m *mountEntry) hasOption(option string) bool {
+	for _, o := range m.Options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+func parseMounts(data []byte) (mounts []mountEntry) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{Path: fields[1], FsType: fields[2], Options: strings.Split(fields[3], ",")})
+	}
+	return
+}
+
+/* DetectCgroupBackend picks the backend for version ("auto", "v1" or "v2")
+ * and points Settings.Paths at the hierarchies listed in /proc/mounts,
+ * except for dirs set in the config file. A v1 cpuset mount wins over
+ * cgroup2 since Android keeps cgroup2 mounted for other controllers.
+ */
+func DetectCgroupBackend(version string) (backend CgroupBackend, err error) {
+	var data []byte
+	layout := &Settings.Paths
+	if data, err = Fs.ReadFile(layout.Proc("mounts")); err != nil {
+		if version == CGROUP_AUTO {
+			return nil, fmt.Errorf("Failed to detect cgroup version: %w", err)
+		}
+		data, err = nil, nil
+	}
+
+	var cpusetMount, cpuMount, unifiedMount *mountEntry
+	mounts := parseMounts(data)
+	for idx := range mounts {
+		m := &mounts[idx]
+		switch m.FsType {
+		case "cgroup":
+			if m.hasOption("cpuset") && cpusetMount == nil {
+				cpusetMount = m
+			} else if m.hasOption("cpu") && cpuMount == nil {
+				cpuMount = m
+			}
+		case "cgroup2":
+			if unifiedMount == nil {
+				unifiedMount = m
+			}
+		}
+	}
+
+	if version == CGROUP_AUTO {
+		switch {
+		case cpusetMount != nil:
+			version = CGROUP_V1
+		case unifiedMount != nil:
+			version = CGROUP_V2
+		default:
+			return nil, fmt.Errorf("Failed to detect cgroup version: no cpuset or cgroup2 mount")
+		}
+	}
+
+	switch version {
+	case CGROUP_V1:
+		if cpusetMount != nil && !layout.Configured("cpuset_dir") {
+			layout.CpusetDir = cpusetMount.Path
+		}
+		if cpuMount != nil && !layout.Configured("cpuctl_dir") {
+			layout.CpuctlDir = cpuMount.Path
+		}
+		backend = CgroupV1{}
+	case CGROUP_V2:
+		if unifiedMount != nil && !layout.Configured("cgroup2_dir") {
+			layout.Cgroup2Dir = unifiedMount.Path
+		}
+		backend = CgroupV2{}
+	default:
+		return nil, fmt.Errorf("Unknown cgroup version: %s", version)
+	}
+	return
+}
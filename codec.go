@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/* Wire layout of a kernel command, all integers little-endian.
+ *
+ * NETLINK_PROTOCOL_V1 uses fixed-size fields:
+ *
+ *   real_len(u32) cmd_len(u32) cmd[NETLINK_CMD_SIZE] args_len(u32) args[NETLINK_ARGS_SIZE]
+ *
+ * cmd and args are NUL/space padded; cmd_len and args_len give the number of
+ * meaningful bytes in each field.
+ *
+ * NETLINK_PROTOCOL_V2 carries variable-length args (e.g. lists of pids):
+ *
+ *   marker(u32) version(u32)=2 cmd_len(u32) args_len(u32) cmd[cmd_len] args[args_len]
+ *
+ * Messages are told apart by their first word: later versions start with
+ * NETLINK_VERSION_MARKER, which a V1 real_len can never be since it would
+ * exceed any netlink message. Everything else is V1.
+ */
+const (
+	NETLINK_PROTOCOL_V1 uint32 = 1
+	NETLINK_PROTOCOL_V2 uint32 = 2
+
+	NETLINK_VERSION_MARKER uint32 = 0xffffffff
+
+	NETLINK_V1_MSG_SIZE  int = 4 + 4 + NETLINK_CMD_SIZE + 4 + NETLINK_ARGS_SIZE
+	NETLINK_V2_HDR_SIZE  int = 4 + 4 + 4 + 4
+	NETLINK_V2_ARGS_SIZE int = 64 * 1024
+)
+
+var (
+	ErrShortBuffer    = errors.New("short buffer")
+	ErrLengthOverflow = errors.New("length overflow")
+	ErrUnknownVersion = errors.New("unknown protocol version")
+)
+
+// CodecError describes where in a message encoding or decoding failed.
+// It wraps one of ErrShortBuffer, ErrLengthOverflow or ErrUnknownVersion.
+type CodecError struct {
+	Err    error
+	Field  string
+	Offset int
+	Want   int
+	Have   int
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("%v: field=%s offset=%d want=%d have=%d", e.Err, e.Field, e.Offset, e.Want, e.Have)
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// NetlinkCodec converts between NetlinkCmd and the kernel wire format.
+// Encode uses Version; Decode accepts any version up to Version.
+type NetlinkCodec struct {
+	Version uint32
+}
+
+var Codec = NewNetlinkCodec(DAEMON_PROTOCOL_VERSION)
+
+func NewNetlinkCodec(version uint32) *NetlinkCodec {
+	return &NetlinkCodec{Version: version}
+}
+
+// WireVersion reports which protocol version data was encoded with
+func WireVersion(data []byte) (version uint32, err error) {
+	if len(data) < 4 {
+		return 0, &CodecError{Err: ErrShortBuffer, Field: "message", Want: 4, Have: len(data)}
+	}
+	if binary.LittleEndian.Uint32(data[:4]) != NETLINK_VERSION_MARKER {
+		return NETLINK_PROTOCOL_V1, nil
+	}
+	if len(data) < 8 {
+		return 0, &CodecError{Err: ErrShortBuffer, Field: "version", Offset: 4, Want: 8, Have: len(data)}
+	}
+	// V1 is never marked
+	if version = binary.LittleEndian.Uint32(data[4:8]); version <= NETLINK_PROTOCOL_V1 {
+		return 0, &CodecError{Err: ErrUnknownVersion, Field: "version", Offset: 4, Want: int(NETLINK_PROTOCOL_V2), Have: int(version)}
+	}
+	return
+}
+
+func (c *NetlinkCodec) Decode(data []byte) (cmd *NetlinkCmd, err error) {
+	var version uint32
+	if version, err = WireVersion(data); err != nil {
+		return
+	}
+	if version > c.Version {
+		return nil, &CodecError{Err: ErrUnknownVersion, Field: "version", Want: int(c.Version), Have: int(version)}
+	}
+	switch version {
+	case NETLINK_PROTOCOL_V1:
+		return decodeV1(data)
+	case NETLINK_PROTOCOL_V2:
+		return decodeV2(data)
+	default:
+		return nil, &CodecError{Err: ErrUnknownVersion, Field: "version", Want: int(c.Version), Have: int(version)}
+	}
+}
+
+func (c *NetlinkCodec) Encode(cmd *NetlinkCmd) (b []byte, err error) {
+	switch c.Version {
+	case NETLINK_PROTOCOL_V1:
+		return encodeV1(cmd)
+	case NETLINK_PROTOCOL_V2:
+		return encodeV2(cmd)
+	default:
+		return nil, &CodecError{Err: ErrUnknownVersion, Field: "version", Want: int(DAEMON_PROTOCOL_VERSION), Have: int(c.Version)}
+	}
+}
+
+func decodeV1(data []byte) (cmd *NetlinkCmd, err error) {
+	if len(data) < NETLINK_V1_MSG_SIZE {
+		return nil, &CodecError{Err: ErrShortBuffer, Field: "message", Want: NETLINK_V1_MSG_SIZE, Have: len(data)}
+	}
+
+	pos := 0
+	// real_len is informational; older kernels disagree on whether it
+	// includes itself, so we only make sure it stays within the buffer.
+	realLen := binary.LittleEndian.Uint32(data[pos : pos+4])
+	if uint64(realLen) > uint64(len(data)) {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "real_len", Offset: pos, Want: int(realLen), Have: len(data)}
+	}
+	pos += 4
+
+	cmdLen := binary.LittleEndian.Uint32(data[pos : pos+4])
+	if cmdLen > uint32(NETLINK_CMD_SIZE) {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "cmd_len", Offset: pos, Want: int(cmdLen), Have: NETLINK_CMD_SIZE}
+	}
+	pos += 4
+	command := trimField(data[pos : pos+int(cmdLen)])
+	pos += NETLINK_CMD_SIZE
+
+	argsLen := binary.LittleEndian.Uint32(data[pos : pos+4])
+	if argsLen > uint32(NETLINK_ARGS_SIZE) {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "args_len", Offset: pos, Want: int(argsLen), Have: NETLINK_ARGS_SIZE}
+	}
+	pos += 4
+	args := trimField(data[pos : pos+int(argsLen)])
+
+	cmd = new(NetlinkCmd)
+	cmd.Cmd = command
+	cmd.Args = args
+	return
+}
+
+func encodeV1(cmd *NetlinkCmd) (b []byte, err error) {
+	if len(cmd.Cmd) > NETLINK_CMD_SIZE {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "cmd", Offset: 8, Want: len(cmd.Cmd), Have: NETLINK_CMD_SIZE}
+	}
+	if len(cmd.Args) > NETLINK_ARGS_SIZE {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "args", Offset: 8 + NETLINK_CMD_SIZE + 4, Want: len(cmd.Args), Have: NETLINK_ARGS_SIZE}
+	}
+
+	b = make([]byte, NETLINK_V1_MSG_SIZE)
+	pos := 0
+	binary.LittleEndian.PutUint32(b[pos:pos+4], uint32(NETLINK_V1_MSG_SIZE-4))
+	pos += 4
+
+	binary.LittleEndian.PutUint32(b[pos:pos+4], uint32(len(cmd.Cmd)))
+	pos += 4
+	copy(b[pos:pos+NETLINK_CMD_SIZE], cmd.Cmd)
+	pos += NETLINK_CMD_SIZE
+
+	binary.LittleEndian.PutUint32(b[pos:pos+4], uint32(len(cmd.Args)))
+	pos += 4
+	copy(b[pos:pos+NETLINK_ARGS_SIZE], cmd.Args)
+	return
+}
+
+func decodeV2(data []byte) (cmd *NetlinkCmd, err error) {
+	if len(data) < NETLINK_V2_HDR_SIZE {
+		return nil, &CodecError{Err: ErrShortBuffer, Field: "header", Want: NETLINK_V2_HDR_SIZE, Have: len(data)}
+	}
+
+	pos := 8
+	cmdLen := binary.LittleEndian.Uint32(data[pos : pos+4])
+	if cmdLen > uint32(NETLINK_CMD_SIZE) {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "cmd_len", Offset: pos, Want: int(cmdLen), Have: NETLINK_CMD_SIZE}
+	}
+	pos += 4
+
+	argsLen := binary.LittleEndian.Uint32(data[pos : pos+4])
+	if argsLen > uint32(NETLINK_V2_ARGS_SIZE) {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "args_len", Offset: pos, Want: int(argsLen), Have: NETLINK_V2_ARGS_SIZE}
+	}
+	pos += 4
+
+	need := NETLINK_V2_HDR_SIZE + int(cmdLen) + int(argsLen)
+	if len(data) < need {
+		return nil, &CodecError{Err: ErrShortBuffer, Field: "message", Offset: pos, Want: need, Have: len(data)}
+	}
+
+	cmd = new(NetlinkCmd)
+	cmd.Cmd = trimField(data[pos : pos+int(cmdLen)])
+	pos += int(cmdLen)
+	cmd.Args = trimField(data[pos : pos+int(argsLen)])
+	return
+}
+
+func encodeV2(cmd *NetlinkCmd) (b []byte, err error) {
+	if len(cmd.Cmd) > NETLINK_CMD_SIZE {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "cmd", Offset: NETLINK_V2_HDR_SIZE, Want: len(cmd.Cmd), Have: NETLINK_CMD_SIZE}
+	}
+	if len(cmd.Args) > NETLINK_V2_ARGS_SIZE {
+		return nil, &CodecError{Err: ErrLengthOverflow, Field: "args", Offset: NETLINK_V2_HDR_SIZE + len(cmd.Cmd), Want: len(cmd.Args), Have: NETLINK_V2_ARGS_SIZE}
+	}
+
+	b = make([]byte, NETLINK_V2_HDR_SIZE, NETLINK_V2_HDR_SIZE+len(cmd.Cmd)+len(cmd.Args))
+	binary.LittleEndian.PutUint32(b[0:4], NETLINK_VERSION_MARKER)
+	binary.LittleEndian.PutUint32(b[4:8], NETLINK_PROTOCOL_V2)
+	binary.LittleEndian.PutUint32(b[8:12], uint32(len(cmd.Cmd)))
+	binary.LittleEndian.PutUint32(b[12:16], uint32(len(cmd.Args)))
+	b = append(b, cmd.Cmd...)
+	b = append(b, cmd.Args...)
+	return
+}
+
+// trimField reads a field as a C string with surrounding spaces removed
+func trimField(b []byte) string {
+	if idx := bytes.IndexByte(b, 0); idx >= 0 {
+		b = b[:idx]
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func encodeOrFatal(t testing.TB, codec *NetlinkCodec, cmd *NetlinkCmd) []byte {
+	b, err := codec.Encode(cmd)
+	if err != nil {
+		t.Fatalf("Encode(%v): %v", cmd, err)
+	}
+	return b
+}
+
+func TestCodecDecodeErrors(t *testing.T) {
+	cmd := &NetlinkCmd{Cmd: "move_to_cgroup", Args: "12 bg true"}
+	v1 := encodeOrFatal(t, NewNetlinkCodec(NETLINK_PROTOCOL_V1), cmd)
+	v2 := encodeOrFatal(t, NewNetlinkCodec(NETLINK_PROTOCOL_V2), cmd)
+
+	// patch returns a copy of b with the u32 at offset set to value
+	patch := func(b []byte, offset int, value uint32) []byte {
+		b = append([]byte(nil), b...)
+		binary.LittleEndian.PutUint32(b[offset:offset+4], value)
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		version uint32
+		data    []byte
+		want    error
+	}{
+		{"empty", NETLINK_PROTOCOL_V2, nil, ErrShortBuffer},
+		{"partial first word", NETLINK_PROTOCOL_V2, v1[:3], ErrShortBuffer},
+		{"truncated v1", NETLINK_PROTOCOL_V2, v1[:len(v1)-1], ErrShortBuffer},
+		{"marker without version", NETLINK_PROTOCOL_V2, v2[:6], ErrShortBuffer},
+		{"truncated v2 header", NETLINK_PROTOCOL_V2, v2[:NETLINK_V2_HDR_SIZE-1], ErrShortBuffer},
+		{"truncated v2 body", NETLINK_PROTOCOL_V2, v2[:len(v2)-1], ErrShortBuffer},
+		{"v1 real_len", NETLINK_PROTOCOL_V2, patch(v1, 0, uint32(len(v1)+1)), ErrLengthOverflow},
+		{"v1 cmd_len", NETLINK_PROTOCOL_V2, patch(v1, 4, uint32(NETLINK_CMD_SIZE+1)), ErrLengthOverflow},
+		{"v1 args_len", NETLINK_PROTOCOL_V2, patch(v1, 8+NETLINK_CMD_SIZE, uint32(NETLINK_ARGS_SIZE+1)), ErrLengthOverflow},
+		{"v2 cmd_len", NETLINK_PROTOCOL_V2, patch(v2, 8, uint32(NETLINK_CMD_SIZE+1)), ErrLengthOverflow},
+		{"v2 args_len", NETLINK_PROTOCOL_V2, patch(v2, 12, uint32(NETLINK_V2_ARGS_SIZE+1)), ErrLengthOverflow},
+		{"v2 on a v1 codec", NETLINK_PROTOCOL_V1, v2, ErrUnknownVersion},
+		{"future version", NETLINK_PROTOCOL_V2, patch(v2, 4, 9), ErrUnknownVersion},
+		{"marked v1", NETLINK_PROTOCOL_V2, patch(v2, 4, NETLINK_PROTOCOL_V1), ErrUnknownVersion},
+		{"marked zero", NETLINK_PROTOCOL_V2, patch(v2, 4, 0), ErrUnknownVersion},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd, err := NewNetlinkCodec(test.version).Decode(test.data)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("Decode = %v, %v; want %v", cmd, err, test.want)
+			}
+			var codecErr *CodecError
+			if !errors.As(err, &codecErr) {
+				t.Fatalf("Decode error %T is not a *CodecError", err)
+			}
+		})
+	}
+}
+
+func TestCodecEncodeErrors(t *testing.T) {
+	long := make([]byte, NETLINK_V2_ARGS_SIZE+1)
+	tests := []struct {
+		name    string
+		version uint32
+		cmd     *NetlinkCmd
+		want    error
+	}{
+		{"v1 cmd", NETLINK_PROTOCOL_V1, &NetlinkCmd{Cmd: string(long[:NETLINK_CMD_SIZE+1])}, ErrLengthOverflow},
+		{"v1 args", NETLINK_PROTOCOL_V1, &NetlinkCmd{Cmd: "a", Args: string(long[:NETLINK_ARGS_SIZE+1])}, ErrLengthOverflow},
+		{"v2 cmd", NETLINK_PROTOCOL_V2, &NetlinkCmd{Cmd: string(long[:NETLINK_CMD_SIZE+1])}, ErrLengthOverflow},
+		{"v2 args", NETLINK_PROTOCOL_V2, &NetlinkCmd{Cmd: "a", Args: string(long)}, ErrLengthOverflow},
+		{"unknown version", 9, &NetlinkCmd{Cmd: "a"}, ErrUnknownVersion},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewNetlinkCodec(test.version).Encode(test.cmd); !errors.Is(err, test.want) {
+				t.Fatalf("Encode = %v; want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestCodecWireVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint32
+	}{
+		{"v1", encodeOrFatal(t, NewNetlinkCodec(NETLINK_PROTOCOL_V1), &NetlinkCmd{Cmd: "a"}), NETLINK_PROTOCOL_V1},
+		{"v2", encodeOrFatal(t, NewNetlinkCodec(NETLINK_PROTOCOL_V2), &NetlinkCmd{Cmd: "a"}), NETLINK_PROTOCOL_V2},
+		// A small real_len used to look like a version number
+		{"v1 real_len 2", []byte{2, 0, 0, 0}, NETLINK_PROTOCOL_V1},
+		{"v1 real_len 0", []byte{0, 0, 0, 0}, NETLINK_PROTOCOL_V1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, err := WireVersion(test.data)
+			if err != nil || version != test.want {
+				t.Fatalf("WireVersion = %d, %v; want %d", version, err, test.want)
+			}
+		})
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, version := range []uint32{NETLINK_PROTOCOL_V1, NETLINK_PROTOCOL_V2} {
+		codec := NewNetlinkCodec(version)
+		for _, cmd := range []*NetlinkCmd{
+			{Cmd: "hello", Args: "2 ack"},
+			{Cmd: "mpdecision", Args: "1"},
+			{Cmd: "move_to_cgroup", Args: "12 bg_non_interactive true"},
+			{Cmd: "move_tasks", Args: "bg false 1 2 3"},
+		} {
+			f.Add(encodeOrFatal(f, codec, cmd))
+		}
+	}
+	f.Add([]byte{})
+	f.Add([]byte{2, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 2, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cmd, err := Codec.Decode(data)
+		if err != nil {
+			var codecErr *CodecError
+			if !errors.As(err, &codecErr) {
+				t.Fatalf("Decode error %T is not a *CodecError", err)
+			}
+			return
+		}
+		version, err := WireVersion(data)
+		if err != nil {
+			t.Fatalf("Decode succeeded but WireVersion failed: %v", err)
+		}
+		codec := NewNetlinkCodec(version)
+		b := encodeOrFatal(t, codec, cmd)
+		again, err := codec.Decode(b)
+		if err != nil || again.Cmd != cmd.Cmd || again.Args != cmd.Args {
+			t.Fatalf("re-decode of %v = %v, %v", cmd, again, err)
+		}
+	})
+}
+
+func FuzzEncodeDecode(f *testing.F) {
+	f.Add("mpdecision", "1")
+	f.Add("move_tasks", "bg false 1 2 3")
+	f.Add(" hello ", "2 ack\x00")
+	f.Add("", "")
+
+	f.Fuzz(func(t *testing.T, name string, args string) {
+		for _, version := range []uint32{NETLINK_PROTOCOL_V1, NETLINK_PROTOCOL_V2} {
+			codec := NewNetlinkCodec(version)
+			b, err := codec.Encode(&NetlinkCmd{Cmd: name, Args: args})
+			if err != nil {
+				if !errors.Is(err, ErrLengthOverflow) {
+					t.Fatalf("v%d Encode: %v", version, err)
+				}
+				continue
+			}
+			cmd, err := codec.Decode(b)
+			if err != nil {
+				t.Fatalf("v%d Decode: %v", version, err)
+			}
+			// Fields are padded on the wire, so padding is not preserved
+			if want := trimField([]byte(name)); cmd.Cmd != want {
+				t.Fatalf("v%d cmd = %q, want %q", version, cmd.Cmd, want)
+			}
+			if want := trimField([]byte(args)); cmd.Args != want {
+				t.Fatalf("v%d args = %q, want %q", version, cmd.Args, want)
+			}
+		}
+	})
+}
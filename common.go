@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/gurupras/gocommons"
 )
 
 const (
@@ -15,35 +18,33 @@ const (
 )
 
 var (
-	Version        string
-	Timestamp      string
-	CpusetBasePath = "/sys/fs/cgroup/cpuset"
-	LogPath        = "/dev/kmsg"
-	LogBuf         *bufio.Writer
+	Version   string
+	Timestamp string
+	LogPath   = "/dev/kmsg"
+	LogBuf    *bufio.Writer
+	// logMutex serializes log lines from concurrent workers
+	logMutex sync.Mutex
+
+	// DryRun logs writes to cgroup and sysfs files instead of doing them
+	DryRun = false
 )
 
 func log(msg ...interface{}) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
 	LogBuf.Write([]byte(fmt.Sprintf("%v: %v\n", TAG, msg)))
 	LogBuf.Flush()
 }
 
 func write(path string, data interface{}) (err error) {
-	var file *gocommons.File
-	var writer gocommons.Writer
-
-	if file, err = gocommons.Open(path, os.O_WRONLY, gocommons.GZ_FALSE); err != nil {
+	text := fmt.Sprintf("%v", data)
+	if DryRun {
+		log(fmt.Sprintf("Dry run: would write '%s' to %s", text, path))
 		return
 	}
-	defer file.Close()
-
-	if writer, err = file.Writer(0); err != nil {
+	if err = Fs.WriteFile(path, []byte(text)); err != nil {
 		return
 	}
-	defer writer.Close()
-	defer writer.Flush()
-
-	text := fmt.Sprintf("%v", data)
-	writer.Write([]byte(text))
 	log(fmt.Sprintf("Successfully wrote '%s' to %s", text, path))
 	return
 }
@@ -61,49 +62,44 @@ func init_logger() {
 }
 
 func migrateTasks(inputFile, outputFile string) (err error) {
-	var tmpInputFile *gocommons.File
-	var tmpOutputFile *gocommons.File
-	var reader *bufio.Scanner
-	var writer gocommons.Writer
+	var input io.ReadCloser
 
-	if tmpInputFile, err = gocommons.Open(inputFile, os.O_RDONLY, gocommons.GZ_FALSE); err != nil {
-		log("Could not open bg cgroup tasks file for copying to bg cpuset")
+	if DryRun {
+		log(fmt.Sprintf("Dry run: would copy %s > %s", inputFile, outputFile))
 		return
 	}
-	defer tmpInputFile.Close()
-
-	if tmpOutputFile, err = gocommons.Open(outputFile, os.O_WRONLY, gocommons.GZ_FALSE); err != nil {
+	if input, err = Fs.Open(inputFile); err != nil {
 		log("Could not open bg cgroup tasks file for copying to bg cpuset")
 		return
 	}
-	defer tmpOutputFile.Close()
-
-	if _, err = tmpInputFile.Seek(0, 0); err != nil {
-		log("Failed to seek on:", tmpInputFile.Path)
-	}
+	defer input.Close()
 
-	if reader, err = tmpInputFile.Reader(0); err != nil {
-		log("Could not get reader to inputFile")
-		return
-	}
-	if writer, err = tmpOutputFile.Writer(0); err != nil {
-		log("Could not get writer to bg cpuset tasks file")
+	if _, err = Fs.Stat(outputFile); err != nil {
+		log("Could not open bg cgroup tasks file for copying to bg cpuset")
 		return
 	}
-	defer writer.Flush()
 
+	// Keep moving the remaining pids past a failure and report the first
+	// one; pids that exited since the read are skipped
+	reader := bufio.NewScanner(input)
 	reader.Split(bufio.ScanLines)
 	numLines := 0
 	for reader.Scan() {
-		numLines++
+		// cgroups take one pid per write
 		pid := reader.Text()
-		if _, err = writer.Write([]byte(pid)); err != nil {
-			log(fmt.Sprintf("Failed to write '%s' > %s", pid, tmpOutputFile.Path))
+		if e := Fs.WriteFile(outputFile, []byte(pid)); e != nil {
+			if errors.Is(e, syscall.ESRCH) {
+				continue
+			}
+			log(fmt.Sprintf("Failed to write '%s' > %s: %v", pid, outputFile, e))
+			if err == nil {
+				err = fmt.Errorf("Failed to move pid %s to %s: %w", pid, outputFile, e)
+			}
 			continue
 		}
-		writer.Flush()
+		numLines++
 	}
-	log(fmt.Sprintf("cat %s > %s (Wrote: %d lines)", tmpInputFile.Path, tmpOutputFile.Path, numLines))
+	log(fmt.Sprintf("cat %s > %s (Wrote: %d lines)", inputFile, outputFile, numLines))
 	return
 }
 
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// Handlers log as they go; tests drop it instead of writing to /dev/kmsg
+func init() {
+	LogBuf = bufio.NewWriter(io.Discard)
+}
+
+func TestMigrateTasks(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V1)
+	layout := &Settings.Paths
+	from := layout.CgroupTasks(BG_CGROUP)
+	to := layout.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_TASKS)
+	for _, pid := range []int{10, 11, 12} {
+		mfs.AddPid(pid)
+		if err := Fs.WriteFile(from, []byte(strconv.Itoa(pid))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An empty cpuset refuses every pid; the first failure is reported
+	if err := migrateTasks(from, to); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("migrateTasks into an empty cpuset = %v, want EINVAL", err)
+	}
+
+	Fs.WriteFile(layout.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_CPUS), []byte("0"))
+	Fs.WriteFile(layout.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_MEMS), []byte("0"))
+	// MemFS takes one pid per write, so this only passes if every pid is
+	// written on its own
+	if err := migrateTasks(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, to); got != "10\n11\n12\n" {
+		t.Fatalf("cpuset tasks = %q", got)
+	}
+}
+
+func TestMigrateTasksSkipsExited(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V1)
+	layout := &Settings.Paths
+	from := layout.CpusetFile(CPUSET_DEFAULT, CPUSET_TASKS)
+	to := layout.CgroupTasks(BG_CGROUP)
+	mfs.AddPid(10)
+	// 20 exited between listing and moving
+	mfs.Create("/tmp/listed", "10\n20\n")
+
+	if err := migrateTasks("/tmp/listed", to); err != nil {
+		t.Fatalf("migrateTasks with an exited pid = %v", err)
+	}
+	if got := readString(t, to); got != "10\n" {
+		t.Fatalf("cgroup tasks = %q", got)
+	}
+	if got := readString(t, from); got != "10\n" {
+		t.Fatalf("cpuset root tasks = %q, cpuset membership should not change", got)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+/* NetlinkConfig selects the netlink channel used to talk to the kernel.
+ * Kernel builds differ in the protocol number and multicast groups they use,
+ * so all of it can be set from flags or the config file.
+ *
+ * PortId is the port the socket binds to; 0 lets the kernel pick one.
+ * BindGroups is the group bitmask passed to bind() and only reaches groups
+ * 1-32; Groups are joined one by one with NETLINK_ADD_MEMBERSHIP and may be
+ * any group number. Replies go to DestPort/DestGroup.
+ */
+type NetlinkConfig struct {
+	Protocol   int      `json:"protocol"`
+	PortId     uint32   `json:"port_id"`
+	BindGroups uint32   `json:"bind_groups"`
+	Groups     []uint32 `json:"groups"`
+	DestPort   uint32   `json:"dest_port"`
+	DestGroup  uint32   `json:"dest_group"`
+}
+
+// Config is the daemon configuration read from --config. Flags given on the
+// command line take precedence over it.
+type Config struct {
+	Netlink NetlinkConfig `json:"netlink"`
+	Paths   PathLayout    `json:"paths"`
+	// Cgroup is "auto", "v1" or "v2"
+	Cgroup string `json:"cgroup"`
+	// Cpusets are created at startup
+	Cpusets []CpusetSpec `json:"cpusets"`
+}
+
+var Settings = DefaultConfig()
+
+func DefaultConfig() *Config {
+	config := new(Config)
+	config.Netlink.Protocol = MPDECISION_COEXIST
+	config.Netlink.DestGroup = 1
+	config.Paths = DefaultPathLayout()
+	config.Cgroup = CGROUP_AUTO
+	return config
+}
+
+// LoadConfig reads a JSON config file; fields it omits keep their defaults
+func LoadConfig(path string) (config *Config, err error) {
+	var data []byte
+	if data, err = os.ReadFile(path); err != nil {
+		return
+	}
+	config = DefaultConfig()
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Failed to parse config '%s': %w", path, err)
+	}
+	var fields struct {
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("Failed to parse config '%s': %w", path, err)
+	}
+	config.Paths.configured = make(map[string]bool)
+	for field := range fields.Paths {
+		config.Paths.configured[field] = true
+	}
+	return
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Larger than NR_CPUS on any device we ship; bounds the memory a bogus
+// list such as "0-4000000000" can make us allocate
+const MAX_CPUS = 4096
+
+/* CpuList is a set of cpus written in the kernel's list format, as used by
+ * cpuset.cpus and /sys/devices/system/cpu/online:
+ *
+ *   "0-3,6,8-9"
+ *
+ * The empty string is the empty set. The zero value is an empty CpuList
+ * and all operations return new lists.
+ */
+type CpuList struct {
+	mask []uint64
+}
+
+func ParseCpuList(text string) (list CpuList, err error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	for _, part := range strings.Split(text, ",") {
+		var first, last uint64
+		bounds := strings.SplitN(part, "-", 2)
+		if first, err = strconv.ParseUint(bounds[0], 10, 32); err != nil {
+			return CpuList{}, fmt.Errorf("invalid cpu list '%s': bad cpu '%s'", text, bounds[0])
+		}
+		last = first
+		if len(bounds) == 2 {
+			if last, err = strconv.ParseUint(bounds[1], 10, 32); err != nil {
+				return CpuList{}, fmt.Errorf("invalid cpu list '%s': bad cpu '%s'", text, bounds[1])
+			}
+		}
+		if last < first {
+			return CpuList{}, fmt.Errorf("invalid cpu list '%s': range %d-%d is reversed", text, first, last)
+		}
+		if last >= MAX_CPUS {
+			return CpuList{}, fmt.Errorf("invalid cpu list '%s': cpu %d out of range", text, last)
+		}
+		for cpu := int(first); cpu <= int(last); cpu++ {
+			list.add(cpu)
+		}
+	}
+	return
+}
+
+func NewCpuList(cpus ...int) (list CpuList) {
+	for _, cpu := range cpus {
+		list.add(cpu)
+	}
+	return
+}
+
+func (list *CpuList) add(cpu int) {
+	for len(list.mask) <= cpu/64 {
+		list.mask = append(list.mask, 0)
+	}
+	list.mask[cpu/64] |= 1 << uint(cpu%64)
+}
+
+func (list CpuList) word(idx int) uint64 {
+	if idx < len(list.mask) {
+		return list.mask[idx]
+	}
+	return 0
+}
+
+func (list CpuList) combine(other CpuList, op func(a, b uint64) uint64) (result CpuList) {
+	n := len(list.mask)
+	if len(other.mask) > n {
+		n = len(other.mask)
+	}
+	result.mask = make([]uint64, n)
+	for idx := range result.mask {
+		result.mask[idx] = op(list.word(idx), other.word(idx))
+	}
+	return
+}
+
+func (list CpuList) Union(other CpuList) CpuList {
+	return list.combine(other, func(a, b uint64) uint64 { return a | b })
+}
+
+func (list CpuList) Intersection(other CpuList) CpuList {
+	return list.combine(other, func(a, b uint64) uint64 { return a & b })
+}
+
+// Difference is the cpus of list that are not in other
+func (list CpuList) Difference(other CpuList) CpuList {
+	return list.combine(other, func(a, b uint64) uint64 { return a &^ b })
+}
+
+func (list CpuList) Contains(cpu int) bool {
+	return cpu >= 0 && list.word(cpu/64)&(1<<uint(cpu%64)) != 0
+}
+
+func (list CpuList) Len() (n int) {
+	for _, word := range list.mask {
+		n += bits.OnesCount64(word)
+	}
+	return
+}
+
+func (list CpuList) IsEmpty() bool {
+	return list.Len() == 0
+}
+
+func (list CpuList) IsSubsetOf(other CpuList) bool {
+	return list.Difference(other).IsEmpty()
+}
+
+func (list CpuList) Equal(other CpuList) bool {
+	return list.IsSubsetOf(other) && other.IsSubsetOf(list)
+}
+
+// Cpus returns the cpus in ascending order
+func (list CpuList) Cpus() (cpus []int) {
+	for idx, word := range list.mask {
+		for word != 0 {
+			bit := bits.TrailingZeros64(word)
+			cpus = append(cpus, idx*64+bit)
+			word &^= 1 << uint(bit)
+		}
+	}
+	return
+}
+
+// String formats the list the way the kernel prints it
+func (list CpuList) String() string {
+	var parts []string
+	cpus := list.Cpus()
+	for idx := 0; idx < len(cpus); {
+		end := idx
+		for end+1 < len(cpus) && cpus[end+1] == cpus[end]+1 {
+			end++
+		}
+		if end == idx {
+			parts = append(parts, strconv.Itoa(cpus[idx]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[idx], cpus[end]))
+		}
+		idx = end + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+func readCpuList(path string) (list CpuList, err error) {
+	var b []byte
+	if b, err = Fs.ReadFile(path); err != nil {
+		return
+	}
+	return ParseCpuList(string(b))
+}
+
+func OnlineCpus() (CpuList, error) {
+	return readCpuList(Settings.Paths.Cpu("online"))
+}
+
+func PossibleCpus() (CpuList, error) {
+	return readCpuList(Settings.Paths.Cpu("possible"))
+}
+
+// ValidateCpus checks that every cpu in list exists and is online, which
+// the kernel requires of cpuset.cpus
+func ValidateCpus(list CpuList) (err error) {
+	var possible, online CpuList
+	if possible, err = PossibleCpus(); err != nil {
+		return fmt.Errorf("Failed to read possible cpus: %w", err)
+	}
+	if missing := list.Difference(possible); !missing.IsEmpty() {
+		return CommandErrorf(syscall.EINVAL, "cpus %s do not exist (possible: %s)", missing.String(), possible.String())
+	}
+	if online, err = OnlineCpus(); err != nil {
+		return fmt.Errorf("Failed to read online cpus: %w", err)
+	}
+	if offline := list.Difference(online); !offline.IsEmpty() {
+		return CommandErrorf(syscall.EINVAL, "cpus %s are offline (online: %s)", offline.String(), online.String())
+	}
+	return nil
+}
+
+// ParseValidCpuList parses text and validates the result with ValidateCpus
+func ParseValidCpuList(text string) (list CpuList, err error) {
+	if list, err = ParseCpuList(text); err != nil {
+		return CpuList{}, CommandErrorf(syscall.EINVAL, "%v", err)
+	}
+	if err = ValidateCpus(list); err != nil {
+		return CpuList{}, err
+	}
+	return
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseCpuList(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+		len  int
+	}{
+		{"0-3,6,8-9", "0-3,6,8-9", 7},
+		{"", "", 0},
+		{" 0-3\n", "0-3", 4},
+		{"3,1,2,0", "0-3", 4},
+		{"1,1,1-2,2", "1-2", 2},
+		{"8-9,0-3,6", "0-3,6,8-9", 7},
+		{"5-5", "5", 1},
+		{"63-64", "63-64", 2},
+		{"4095", "4095", 1},
+	}
+	for _, test := range tests {
+		list, err := ParseCpuList(test.text)
+		if err != nil {
+			t.Errorf("ParseCpuList(%q): %v", test.text, err)
+			continue
+		}
+		if got := list.String(); got != test.want || list.Len() != test.len {
+			t.Errorf("ParseCpuList(%q) = %q (%d cpus), want %q (%d cpus)", test.text, got, list.Len(), test.want, test.len)
+		}
+		// The kernel's own format reads back as the same list
+		if again, err := ParseCpuList(list.String()); err != nil || !again.Equal(list) {
+			t.Errorf("round trip of %q = %v, %v", list.String(), again, err)
+		}
+	}
+}
+
+func TestParseCpuListErrors(t *testing.T) {
+	for _, text := range []string{
+		"3-1",
+		"4096",
+		"0-4096",
+		"0-4000000000",
+		"99999999999",
+		"-1",
+		"1-",
+		"1-2-3",
+		"1,,2",
+		",",
+		"a",
+		"0x1",
+		"1 2",
+	} {
+		if list, err := ParseCpuList(text); err == nil {
+			t.Errorf("ParseCpuList(%q) = %v, want an error", text, list)
+		}
+	}
+}
+
+func TestCpuListSetOps(t *testing.T) {
+	parse := func(text string) CpuList {
+		list, err := ParseCpuList(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	tests := []struct {
+		a, b                            string
+		union, intersection, difference string
+	}{
+		{"0-3", "2-5", "0-5", "2-3", "0-1"},
+		{"0-3", "", "0-3", "", "0-3"},
+		{"", "0-3", "0-3", "", ""},
+		{"0,64,130", "64-129", "0,64-130", "64", "0,130"},
+		{"1", "1", "1", "1", ""},
+	}
+	for _, test := range tests {
+		a, b := parse(test.a), parse(test.b)
+		if got := a.Union(b).String(); got != test.union {
+			t.Errorf("%q union %q = %q, want %q", test.a, test.b, got, test.union)
+		}
+		if got := a.Intersection(b).String(); got != test.intersection {
+			t.Errorf("%q intersection %q = %q, want %q", test.a, test.b, got, test.intersection)
+		}
+		if got := a.Difference(b).String(); got != test.difference {
+			t.Errorf("%q difference %q = %q, want %q", test.a, test.b, got, test.difference)
+		}
+	}
+}
+
+func TestValidateCpus(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V1)
+	mfs.WriteFile(Settings.Paths.Cpu("possible"), []byte("0-7\n"))
+	mfs.WriteFile(Settings.Paths.Cpu("online"), []byte("0-3,6\n"))
+	tests := []struct {
+		text  string
+		errno syscall.Errno
+	}{
+		{"0-3", 0},
+		{"6", 0},
+		{"", 0},
+		{"4", syscall.EINVAL},
+		{"0-7", syscall.EINVAL},
+		{"8", syscall.EINVAL},
+		{"3-1", syscall.EINVAL},
+	}
+	for _, test := range tests {
+		_, err := ParseValidCpuList(test.text)
+		if test.errno == 0 && err != nil {
+			t.Errorf("ParseValidCpuList(%q) = %v", test.text, err)
+		}
+		if test.errno != 0 && ErrnoOf(err) != test.errno {
+			t.Errorf("ParseValidCpuList(%q) = %v, want errno %d", test.text, err, test.errno)
+		}
+	}
+
+	// Without the sysfs files nothing can be validated
+	Fs = NewMemFS()
+	if err := ValidateCpus(NewCpuList(0)); err == nil {
+		t.Error("ValidateCpus without sysfs succeeded")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	CPUSET_CPU_EXCLUSIVE = "cpuset.cpu_exclusive"
+	// cgroup v2 replaces cpu_exclusive with partitions
+	CPUSET_PARTITION = "cpuset.cpus.partition"
+)
+
+// CpusetSpec declares a cpuset, e.g. in the "cpusets" list of the config
+// file:
+//
+//	{"name": "cs_bg_non_interactive", "cpus": "0", "mems": "0"}
+//
+// A missing cpu_exclusive leaves the exclusivity of the cpuset alone.
+type CpusetSpec struct {
+	Name         string `json:"name"`
+	Cpus         string `json:"cpus"`
+	Mems         string `json:"mems"`
+	CpuExclusive *bool  `json:"cpu_exclusive"`
+}
+
+// CpusetManager creates, configures and removes cpusets through Cgroups
+// and Fs. Cpusets are flat: every cpuset is a child of the root cpuset.
+type CpusetManager struct {
+	mutex sync.Mutex
+}
+
+var Cpusets = NewCpusetManager()
+
+func NewCpusetManager() *CpusetManager {
+	return new(CpusetManager)
+}
+
+func ValidateCpusetName(name string) error {
+	if !validCgroupName(name) {
+		return CommandErrorf(syscall.EINVAL, "invalid cpuset: '%s'", name)
+	}
+	return nil
+}
+
+// ValidateCgroupName accepts names of cgroups directly below a hierarchy
+// root, so that they cannot escape it
+func ValidateCgroupName(name string) error {
+	if !validCgroupName(name) {
+		return CommandErrorf(syscall.EINVAL, "invalid cgroup: '%s'", name)
+	}
+	return nil
+}
+
+func validCgroupName(name string) bool {
+	return name != "" && !strings.Contains(name, "/") && name != "." && name != ".."
+}
+
+// Create makes the cpuset directory; it is not an error if it exists
+func (manager *CpusetManager) Create(name string) (err error) {
+	if err = ValidateCpusetName(name); err != nil {
+		return
+	}
+	if name == CPUSET_DEFAULT {
+		return nil
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if err = Fs.Mkdir(Cgroups.Cpuset(name)); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("Failed to create cpuset '%s': %w", name, err)
+	}
+	log(fmt.Sprintf("Created cpuset '%s'", name))
+	return nil
+}
+
+// Configure sets the cpus, mems and exclusivity of an existing cpuset.
+// Empty Cpus or Mems and a nil CpuExclusive are left alone.
+func (manager *CpusetManager) Configure(spec *CpusetSpec) (err error) {
+	var cpus, mems CpuList
+	if err = ValidateCpusetName(spec.Name); err != nil {
+		return
+	}
+	if cpus, err = ParseValidCpuList(spec.Cpus); err != nil {
+		return
+	}
+	// mems use the same list syntax but name memory nodes, not cpus
+	if mems, err = ParseCpuList(spec.Mems); err != nil {
+		return CommandErrorf(syscall.EINVAL, "%v", err)
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	// mems first: a v1 cpuset takes no tasks until both are set, and the
+	// order keeps the window with only one of them set short
+	if spec.Mems != "" {
+		if err = write(Cgroups.CpusetFile(spec.Name, CPUSET_MEMS), mems); err != nil {
+			return
+		}
+	}
+	if spec.Cpus != "" {
+		if err = write(Cgroups.CpusetFile(spec.Name, CPUSET_CPUS), cpus); err != nil {
+			return
+		}
+	}
+	if spec.Name == CPUSET_DEFAULT || spec.CpuExclusive == nil {
+		return
+	}
+	switch Cgroups.Version() {
+	case CGROUP_V2:
+		partition := "member"
+		if *spec.CpuExclusive {
+			partition = "root"
+		}
+		err = write(Cgroups.CpusetFile(spec.Name, CPUSET_PARTITION), partition)
+	default:
+		exclusive := 0
+		if *spec.CpuExclusive {
+			exclusive = 1
+		}
+		err = write(Cgroups.CpusetFile(spec.Name, CPUSET_CPU_EXCLUSIVE), exclusive)
+	}
+	return
+}
+
+// Ensure creates the cpuset if needed and configures it
+func (manager *CpusetManager) Ensure(spec *CpusetSpec) (err error) {
+	if err = manager.Create(spec.Name); err != nil {
+		return
+	}
+	return manager.Configure(spec)
+}
+
+// Tasks lists the tids in a cpuset
+func (manager *CpusetManager) Tasks(name string) (tids []int, err error) {
+	var b []byte
+	if err = ValidateCpusetName(name); err != nil {
+		return
+	}
+	if b, err = Fs.ReadFile(Cgroups.CpusetTasks(name)); err != nil {
+		return
+	}
+	for _, line := range strings.Fields(string(b)) {
+		var tid int
+		if tid, err = strconv.Atoi(line); err != nil {
+			return nil, fmt.Errorf("Bad tid '%s' in cpuset '%s'", line, name)
+		}
+		tids = append(tids, tid)
+	}
+	return
+}
+
+// Remove moves the tasks of a cpuset to the root cpuset and deletes it.
+// Tasks that exit while being moved are ignored.
+func (manager *CpusetManager) Remove(name string) (err error) {
+	var tids []int
+	if err = ValidateCpusetName(name); err != nil {
+		return
+	}
+	if name == CPUSET_DEFAULT {
+		return CommandErrorf(syscall.EPERM, "cannot remove the root cpuset")
+	}
+	if tids, err = manager.Tasks(name); err != nil {
+		return
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	parentTasks := Cgroups.CpusetTasks(CPUSET_DEFAULT)
+	for _, tid := range tids {
+		if err = write(parentTasks, tid); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("Failed to drain tid %d from cpuset '%s': %w", tid, name, err)
+		}
+	}
+	if err = Fs.Remove(Cgroups.Cpuset(name)); err != nil {
+		return fmt.Errorf("Failed to remove cpuset '%s': %w", name, err)
+	}
+	log(fmt.Sprintf("Removed cpuset '%s' (moved %d tasks to root)", name, len(tids)))
+	return nil
+}
+
+// EnsureCpusets creates every cpuset declared in specs
+func (manager *CpusetManager) EnsureCpusets(specs []CpusetSpec) (err error) {
+	for idx := range specs {
+		if err = manager.Ensure(&specs[idx]); err != nil {
+			return fmt.Errorf("cpuset '%s': %w", specs[idx].Name, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCpusetConfigureExclusive(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		version   string
+		file      string
+		exclusive *bool
+		want      string
+	}{
+		{CGROUP_V1, CPUSET_CPU_EXCLUSIVE, nil, "set by hand"},
+		{CGROUP_V1, CPUSET_CPU_EXCLUSIVE, &yes, "1"},
+		{CGROUP_V1, CPUSET_CPU_EXCLUSIVE, &no, "0"},
+		{CGROUP_V2, CPUSET_PARTITION, nil, "set by hand"},
+		{CGROUP_V2, CPUSET_PARTITION, &yes, "root"},
+		{CGROUP_V2, CPUSET_PARTITION, &no, "member"},
+	}
+	for _, test := range tests {
+		useMemFS(t, test.version)
+		spec := &CpusetSpec{Name: "cs_top", Cpus: "2-3", Mems: "0", CpuExclusive: test.exclusive}
+		if err := Cpusets.Create(spec.Name); err != nil {
+			t.Fatal(err)
+		}
+		path := Cgroups.CpusetFile(spec.Name, test.file)
+		Fs.WriteFile(path, []byte("set by hand"))
+		if err := Cpusets.Configure(spec); err != nil {
+			t.Fatalf("%s: Configure(%v) = %v", test.version, spec, err)
+		}
+		if got := strings.TrimSpace(readString(t, path)); got != test.want {
+			t.Errorf("%s: %s = %q, want %q", test.version, test.file, got, test.want)
+		}
+	}
+}
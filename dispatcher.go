@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type dispatchItem struct {
+	sender  *NetlinkSender
+	cmd     *NetlinkCmd
+	barrier *dispatchBarrier
+}
+
+// dispatchBarrier holds a command queued on several workers. The first of
+// them runs it once all have reached it; the others wait until it is done.
+type dispatchBarrier struct {
+	owner   chan dispatchItem
+	arrived sync.WaitGroup
+	done    chan struct{}
+	// dropped is set before arrived completes if queueing timed out
+	dropped bool
+}
+
+/* Dispatcher runs commands on a fixed pool of workers. Every command is
+ * hashed onto a worker by its ordering keys (see OrderingKeys) so commands
+ * touching the same pid or cpuset run in arrival order, while unrelated
+ * commands run in parallel.
+ *
+ * A command whose keys land on several workers, such as a batch or a move
+ * of a pid into a cgroup, is queued on each of them behind a barrier: it runs once every one of those workers has
+ * finished the commands queued before it, and they resume once it is done.
+ *
+ * Each worker has a bounded queue. When it is full Submit blocks for up to
+ * QueueTimeout, pushing back on the receive loop, and then drops the
+ * command.
+ */
+type Dispatcher struct {
+	QueueTimeout time.Duration
+	queues       []chan dispatchItem
+	run          func(sender *NetlinkSender, cmd *NetlinkCmd)
+	registry     *Registry
+	wg           sync.WaitGroup
+	// barrierMutex keeps barriers in the same order on every queue
+	barrierMutex sync.Mutex
+	submitted    uint64
+	dropped      uint64
+}
+
+func NewDispatcher(registry *Registry, workers int, queueLen int, queueTimeout time.Duration, run func(*NetlinkSender, *NetlinkCmd)) (d *Dispatcher) {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueLen < 1 {
+		queueLen = 1
+	}
+	d = new(Dispatcher)
+	d.QueueTimeout = queueTimeout
+	d.registry = registry
+	d.run = run
+	d.queues = make([]chan dispatchItem, workers)
+	for idx := range d.queues {
+		d.queues[idx] = make(chan dispatchItem, queueLen)
+		d.wg.Add(1)
+		go d.worker(d.queues[idx])
+	}
+	return
+}
+
+func (d *Dispatcher) worker(queue chan dispatchItem) {
+	defer d.wg.Done()
+	for item := range queue {
+		if barrier := item.barrier; barrier != nil {
+			barrier.arrived.Done()
+			if barrier.owner != queue {
+				<-barrier.done
+				continue
+			}
+			barrier.arrived.Wait()
+			if !barrier.dropped {
+				d.run(item.sender, item.cmd)
+			}
+			close(barrier.done)
+			continue
+		}
+		d.run(item.sender, item.cmd)
+	}
+}
+
+// OrderingKeys groups commands that must not be reordered: by every pid
+// the command carries and by every cpuset or cgroup it writes, falling
+// back to the command name. mpdecision rewrites the bg and fg_bg cpusets
+// and drains the bg cgroup into its cpuset, so it is keyed by those.
+func (d *Dispatcher) OrderingKeys(cmd *NetlinkCmd) (keys []string) {
+	c, ok := d.registry.Lookup(cmd.Cmd)
+	if !ok {
+		return []string{cmd.Cmd}
+	}
+	args, err := c.Parse(cmd.Args)
+	if err != nil {
+		return []string{cmd.Cmd}
+	}
+	if cmd.Cmd == "mpdecision" {
+		return []string{"cgroup:" + BG_CGROUP, "cpuset:" + CgroupCpuset(BG_CGROUP), "cpuset:" + CgroupCpuset(FG_BG_CGROUP)}
+	}
+	if args.Has("pid") {
+		keys = append(keys, "pid:"+strconv.Itoa(args.Int("pid")))
+	}
+	for _, pid := range args.IntList("pids") {
+		keys = append(keys, "pid:"+strconv.Itoa(pid))
+	}
+	if args.Has("cpuset") {
+		keys = append(keys, "cpuset:"+args.String("cpuset"))
+	}
+	if args.Has("cgroup") {
+		keys = append(keys, "cgroup:"+args.String("cgroup"))
+		if args.Bool("should_assign_cpuset") {
+			keys = append(keys, "cpuset:"+CgroupCpuset(args.String("cgroup")))
+		}
+	}
+	if len(keys) == 0 {
+		return []string{cmd.Cmd}
+	}
+	return
+}
+
+// queuesFor returns the queues of keys without duplicates, in queue order
+func (d *Dispatcher) queuesFor(keys []string) (queues []chan dispatchItem) {
+	seen := make(map[uint32]bool)
+	var indices []int
+	for _, key := range keys {
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		idx := hash.Sum32() % uint32(len(d.queues))
+		if !seen[idx] {
+			seen[idx] = true
+			indices = append(indices, int(idx))
+		}
+	}
+	sort.Ints(indices)
+	for _, idx := range indices {
+		queues = append(queues, d.queues[idx])
+	}
+	return
+}
+
+// enqueue puts item on queue, waiting until deadline fires if it is full
+func enqueue(queue chan dispatchItem, item dispatchItem, deadline <-chan time.Time) bool {
+	select {
+	case queue <- item:
+		return true
+	default:
+	}
+	select {
+	case queue <- item:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// Submit queues cmd. If a worker's queue stays full for QueueTimeout the
+// command is dropped and EAGAIN is returned.
+func (d *Dispatcher) Submit(sender *NetlinkSender, cmd *NetlinkCmd) error {
+	queues := d.queuesFor(d.OrderingKeys(cmd))
+	timer := time.NewTimer(d.QueueTimeout)
+	defer timer.Stop()
+
+	item := dispatchItem{sender: sender, cmd: cmd}
+	if len(queues) > 1 {
+		d.barrierMutex.Lock()
+		defer d.barrierMutex.Unlock()
+		item.barrier = &dispatchBarrier{owner: queues[0], done: make(chan struct{})}
+		item.barrier.arrived.Add(len(queues))
+	}
+	for idx, queue := range queues {
+		if enqueue(queue, item, timer.C) {
+			continue
+		}
+		if item.barrier != nil {
+			// Release the workers that already hold the barrier
+			item.barrier.dropped = true
+			item.barrier.arrived.Add(idx - len(queues))
+		}
+		dropped := atomic.AddUint64(&d.dropped, 1)
+		log(fmt.Sprintf("Dropped %v: queue full (total dropped: %d)", cmd.String(), dropped))
+		return CommandErrorf(syscall.EAGAIN, "queue full")
+	}
+	atomic.AddUint64(&d.submitted, 1)
+	return nil
+}
+
+func (d *Dispatcher) Submitted() uint64 {
+	return atomic.LoadUint64(&d.submitted)
+}
+
+func (d *Dispatcher) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+// Stop waits for queued commands to finish. Submit must not be called
+// afterwards.
+func (d *Dispatcher) Stop() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.wg.Wait()
+}
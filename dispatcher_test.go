@@ -0,0 +1,183 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dispatchLog records the commands run by a test dispatcher in order
+type dispatchLog struct {
+	mutex sync.Mutex
+	ran   []string
+}
+
+func (l *dispatchLog) run(sender *NetlinkSender, cmd *NetlinkCmd) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ran = append(l.ran, cmd.String())
+}
+
+func (l *dispatchLog) index(cmd string) int {
+	for idx, ran := range l.ran {
+		if ran == cmd {
+			return idx
+		}
+	}
+	return -1
+}
+
+func testRegistry(t *testing.T) *Registry {
+	registry := NewRegistry()
+	if err := RegisterCommands(registry); err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestOrderingKeys(t *testing.T) {
+	d := NewDispatcher(testRegistry(t), 1, 1, time.Second, func(*NetlinkSender, *NetlinkCmd) {})
+	defer d.Stop()
+	tests := []struct {
+		cmd  string
+		args string
+		want []string
+	}{
+		{"cpuset", "cs_top 10", []string{"pid:10", "cpuset:cs_top"}},
+		{"move_to_cgroup", "10 bg_non_interactive false", []string{"pid:10", "cgroup:bg_non_interactive"}},
+		{"move_to_cgroup", "10 bg_non_interactive true", []string{"pid:10", "cgroup:bg_non_interactive", "cpuset:cs_bg_non_interactive"}},
+		{"move_tasks", "fg_bg false 1 2", []string{"pid:1", "pid:2", "cgroup:fg_bg"}},
+		{"mpdecision", "true", []string{"cgroup:bg_non_interactive", "cpuset:cs_bg_non_interactive", "cpuset:cs_fg_bg"}},
+		{"mpdecision", "maybe", []string{"mpdecision"}},
+		{"unknown", "1", []string{"unknown"}},
+	}
+	for _, test := range tests {
+		cmd := &NetlinkCmd{Cmd: test.cmd, Args: test.args}
+		if got := d.OrderingKeys(cmd); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("OrderingKeys(%v) = %v, want %v", cmd, got, test.want)
+		}
+	}
+}
+
+// pidsOnOtherQueues finds two pids that hash onto different queues of d
+func pidsOnOtherQueues(t *testing.T, d *Dispatcher) (int, int) {
+	first := d.queuesFor([]string{"pid:1"})[0]
+	for pid := 2; pid < 100; pid++ {
+		if d.queuesFor([]string{"pid:" + strconv.Itoa(pid)})[0] != first {
+			return 1, pid
+		}
+	}
+	t.Fatal("every pid hashes onto one queue")
+	return 0, 0
+}
+
+func TestDispatcherKeyOrder(t *testing.T) {
+	var ran dispatchLog
+	d := NewDispatcher(testRegistry(t), 4, 64, time.Second, ran.run)
+	a, b := pidsOnOtherQueues(t, d)
+
+	// Different pids on the same cpuset keep their arrival order
+	var want []string
+	for idx := 0; idx < 20; idx++ {
+		pid := a
+		if idx%2 == 1 {
+			pid = b
+		}
+		cmd := &NetlinkCmd{Cmd: "cpuset", Args: "cs_top " + strconv.Itoa(pid)}
+		if err := d.Submit(nil, cmd); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, cmd.String())
+	}
+	d.Stop()
+	if !reflect.DeepEqual(ran.ran, want) {
+		t.Fatalf("ran %v, want %v", ran.ran, want)
+	}
+}
+
+func TestDispatcherBarrier(t *testing.T) {
+	var ran dispatchLog
+	d := NewDispatcher(testRegistry(t), 4, 64, time.Second, ran.run)
+	a, b := pidsOnOtherQueues(t, d)
+	pidA, pidB := strconv.Itoa(a), strconv.Itoa(b)
+
+	// cpuset commands to distinct cpusets hash by pid; the batch spans both
+	before := []*NetlinkCmd{{Cmd: "cpuset", Args: "cs_a " + pidA}, {Cmd: "cpuset", Args: "cs_b " + pidB}}
+	batch := &NetlinkCmd{Cmd: "move_tasks", Args: "fg_bg false " + pidA + " " + pidB}
+	after := []*NetlinkCmd{{Cmd: "cpuset", Args: "cs_c " + pidA}, {Cmd: "cpuset", Args: "cs_d " + pidB}}
+	for _, cmd := range append(append(before, batch), after...) {
+		if err := d.Submit(nil, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Stop()
+	at := ran.index(batch.String())
+	for _, cmd := range before {
+		if ran.index(cmd.String()) > at {
+			t.Errorf("%v ran after the batch: %v", cmd, ran.ran)
+		}
+	}
+	for _, cmd := range after {
+		if ran.index(cmd.String()) < at {
+			t.Errorf("%v ran before the batch: %v", cmd, ran.ran)
+		}
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var ran dispatchLog
+	d := NewDispatcher(testRegistry(t), 1, 1, 20*time.Millisecond, func(sender *NetlinkSender, cmd *NetlinkCmd) {
+		select {
+		case started <- struct{}{}:
+			<-release
+		default:
+		}
+		ran.run(sender, cmd)
+	})
+
+	// The worker holds the first command and the second fills the queue
+	if err := d.Submit(nil, &NetlinkCmd{Cmd: "cpuset", Args: "cs_top 1"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := d.Submit(nil, &NetlinkCmd{Cmd: "cpuset", Args: "cs_top 2"}); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 2; idx++ {
+		if err := d.Submit(nil, &NetlinkCmd{Cmd: "cpuset", Args: "cs_top 3"}); ErrnoOf(err) != syscall.EAGAIN {
+			t.Fatalf("Submit to a full queue = %v, want EAGAIN", err)
+		}
+	}
+	if d.Submitted() != 2 || d.Dropped() != 2 {
+		t.Fatalf("submitted %d dropped %d, want 2 and 2", d.Submitted(), d.Dropped())
+	}
+	close(release)
+	d.Stop()
+	if len(ran.ran) != 2 {
+		t.Fatalf("ran %v, want the 2 queued commands", ran.ran)
+	}
+}
+
+func TestDispatcherStopDrains(t *testing.T) {
+	release := make(chan struct{})
+	var ran dispatchLog
+	d := NewDispatcher(testRegistry(t), 2, 16, time.Second, func(sender *NetlinkSender, cmd *NetlinkCmd) {
+		<-release
+		ran.run(sender, cmd)
+	})
+	for pid := 0; pid < 10; pid++ {
+		if err := d.Submit(nil, &NetlinkCmd{Cmd: "cpuset", Args: "cs_top " + strconv.Itoa(pid)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+	d.Stop()
+	if len(ran.ran) != 10 {
+		t.Fatalf("Stop returned after %d of 10 commands", len(ran.ran))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/gurupras/gocommons"
+)
+
+// FS is the filesystem the handlers read and write cgroup and sysfs files
+// through. OsFS is the real one; MemFS emulates cgroups in memory.
+//
+// WriteFile never creates files: like sysfs and cgroupfs, writing to a
+// path that does not exist fails with ENOENT.
+type FS interface {
+	Open(path string) (io.ReadCloser, error)
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte) error
+	Mkdir(path string) error
+	Remove(path string) error
+	Stat(path string) (os.FileInfo, error)
+	// ReadDir lists the names in a directory, sorted
+	ReadDir(path string) ([]string, error)
+}
+
+var Fs FS = OsFS{}
+
+type OsFS struct{}
+
+func (OsFS) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (OsFS) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (OsFS) WriteFile(path string, data []byte) (err error) {
+	var file *gocommons.File
+	var writer gocommons.Writer
+
+	if file, err = gocommons.Open(path, os.O_WRONLY, gocommons.GZ_FALSE); err != nil {
+		return
+	}
+	defer file.Close()
+
+	if writer, err = file.Writer(0); err != nil {
+		return
+	}
+	defer writer.Close()
+
+	if _, err = writer.Write(data); err != nil {
+		return
+	}
+	// cgroup files report errors such as ESRCH when the data is flushed
+	return writer.Flush()
+}
+
+func (OsFS) Mkdir(path string) error {
+	return os.Mkdir(path, 0755)
+}
+
+func (OsFS) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (OsFS) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (OsFS) ReadDir(path string) (names []string, err error) {
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(path); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return
+}
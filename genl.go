@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Generic netlink controller constants (include/uapi/linux/genetlink.h)
+const (
+	GENL_HDRLEN           = 4
+	GENL_ID_CTRL          = 0x10
+	CTRL_CMD_GETFAMILY    = 3
+	CTRL_ATTR_FAMILY_ID   = 1
+	CTRL_ATTR_FAMILY_NAME = 2
+
+	GENL_FAMILY_VERSION = 1
+)
+
+/* Commands and attributes of the thermaplan generic netlink family. The
+ * kernel addresses the daemon with one genl command per daemon command and
+ * carries each argument as an attribute. The daemon answers every message
+ * with GENL_CMD_REPLY carrying the reply text (acks, hello, ...).
+ */
+const (
+	GENL_CMD_UNSPEC = iota
+	GENL_CMD_HELLO
+	GENL_CMD_MPDECISION
+	GENL_CMD_MOVE_TO_CGROUP
+	GENL_CMD_CPUSET
+	GENL_CMD_MOVE_TASKS
+	GENL_CMD_REPLY
+)
+
+const (
+	GENL_A_UNSPEC   = iota
+	GENL_A_PID      // u32
+	GENL_A_PIDS     // array of u32
+	GENL_A_CGROUP   // string
+	GENL_A_CPUSET   // string
+	GENL_A_FLAG     // u8
+	GENL_A_VERSION  // u32
+	GENL_A_FEATURES // string
+	GENL_A_TEXT     // string
+)
+
+var GenlFamilyName = "THERMAPLAN"
+
+var genlCommands = map[uint8]string{
+	GENL_CMD_HELLO:          "hello",
+	GENL_CMD_MPDECISION:     "mpdecision",
+	GENL_CMD_MOVE_TO_CGROUP: "move_to_cgroup",
+	GENL_CMD_CPUSET:         "cpuset",
+	GENL_CMD_MOVE_TASKS:     "move_tasks",
+}
+
+// Attribute carrying each registry argument, by ArgSpec.Name
+var genlArgAttrs = map[string]uint16{
+	"pid":                  GENL_A_PID,
+	"pids":                 GENL_A_PIDS,
+	"cgroup":               GENL_A_CGROUP,
+	"cpuset":               GENL_A_CPUSET,
+	"block":                GENL_A_FLAG,
+	"should_assign_cpuset": GENL_A_FLAG,
+	"version":              GENL_A_VERSION,
+	"features":             GENL_A_FEATURES,
+}
+
+// CommandDecoder is implemented by transports whose messages are not in the
+// Codec wire format.
+type CommandDecoder interface {
+	DecodeCommand(message syscall.NetlinkMessage) (*NetlinkCmd, error)
+}
+
+// GenlSocket talks to the kernel over a generic netlink family resolved by
+// name at startup.
+type GenlSocket struct {
+	Fd       int
+	Addr     syscall.SockaddrNetlink
+	Family   string
+	FamilyId uint16
+}
+
+func appendAttr(b []byte, attrType uint16, data []byte) []byte {
+	attrLen := syscall.SizeofNlAttr + len(data)
+	hdr := make([]byte, syscall.SizeofNlAttr)
+	binary.LittleEndian.PutUint16(hdr[0:2], uint16(attrLen))
+	binary.LittleEndian.PutUint16(hdr[2:4], attrType)
+	b = append(b, hdr...)
+	b = append(b, data...)
+	return nlmsgPad(b)
+}
+
+func parseAttrs(b []byte) (attrs map[uint16][]byte, err error) {
+	attrs = make(map[uint16][]byte)
+	for len(b) >= syscall.SizeofNlAttr {
+		attrLen := int(binary.LittleEndian.Uint16(b[0:2]))
+		attrType := binary.LittleEndian.Uint16(b[2:4]) & ^uint16(syscall.NLA_F_NESTED|syscall.NLA_F_NET_BYTEORDER)
+		if attrLen < syscall.SizeofNlAttr || attrLen > len(b) {
+			return nil, &CodecError{Err: ErrLengthOverflow, Field: "nla_len", Want: attrLen, Have: len(b)}
+		}
+		attrs[attrType] = b[syscall.SizeofNlAttr:attrLen]
+		aligned := (attrLen + syscall.NLA_ALIGNTO - 1) & ^(syscall.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return
+}
+
+func attrString(data []byte) string {
+	return strings.TrimRight(string(data), "\x00")
+}
+
+func attrU32(data []byte) (uint32, error) {
+	if len(data) < 4 {
+		return 0, &CodecError{Err: ErrShortBuffer, Field: "u32", Want: 4, Have: len(data)}
+	}
+	return binary.LittleEndian.Uint32(data[:4]), nil
+}
+
+func (gs *GenlSocket) message(msgType uint16, seq uint32, cmd uint8, attrs []byte) []byte {
+	var hdr syscall.NlMsghdr
+	hdr.Len = uint32(syscall.NLMSG_HDRLEN + GENL_HDRLEN + len(attrs))
+	hdr.Type = msgType
+	hdr.Flags = syscall.NLM_F_REQUEST
+	hdr.Seq = seq
+	hdr.Pid = gs.Addr.Pid
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, hdr)
+	buf.Write([]byte{cmd, GENL_FAMILY_VERSION, 0, 0})
+	buf.Write(attrs)
+	return buf.Bytes()
+}
+
+// Send carries the text of a reply in a GENL_A_TEXT attribute
+func (gs *GenlSocket) Send(m *Message) error {
+	var destAddr syscall.SockaddrNetlink
+	destAddr.Family = syscall.AF_NETLINK
+
+	if m.Kind != MESSAGE_REPLY {
+		return fmt.Errorf("genl transport only sends replies")
+	}
+	attrs := appendAttr(nil, GENL_A_TEXT, append([]byte(m.Text), 0))
+	message := gs.message(gs.FamilyId, m.Seq, GENL_CMD_REPLY, attrs)
+	Capture.Outbound(syscall.NETLINK_GENERIC, message)
+	return syscall.Sendto(gs.Fd, message, 0, &destAddr)
+}
+
+func (gs *GenlSocket) Recv() (messages []syscall.NetlinkMessage, peer *Peer, err error) {
+	var b []byte
+	if b, peer, err = recvNetlinkDatagram(gs.Fd); err != nil {
+		return
+	}
+	Capture.Inbound(syscall.NETLINK_GENERIC, b)
+	return parseNetlinkDatagram(b, peer)
+}
+
+// Close fails with EBADF the second time instead of closing an fd number
+// that may have been reused since
+func (gs *GenlSocket) Close() (err error) {
+	if gs.Fd < 0 {
+		return syscall.EBADF
+	}
+	err = syscall.Close(gs.Fd)
+	gs.Fd = -1
+	return
+}
+
+// DecodeCommand turns a genl message into the textual NetlinkCmd the
+// handlers expect, ordering arguments by the command's registry schema.
+func (gs *GenlSocket) DecodeCommand(message syscall.NetlinkMessage) (cmd *NetlinkCmd, err error) {
+	if message.Header.Type != gs.FamilyId {
+		return nil, fmt.Errorf("Unexpected genl message type %d", message.Header.Type)
+	}
+	if len(message.Data) < GENL_HDRLEN {
+		return nil, &CodecError{Err: ErrShortBuffer, Field: "genlmsghdr", Want: GENL_HDRLEN, Have: len(message.Data)}
+	}
+	name, ok := genlCommands[message.Data[0]]
+	if !ok {
+		return nil, CommandErrorf(syscall.EOPNOTSUPP, "unknown genl command %d", message.Data[0])
+	}
+	c, ok := Commands.Lookup(name)
+	if !ok {
+		return nil, CommandErrorf(syscall.EOPNOTSUPP, "unknown command: %s", name)
+	}
+
+	var attrs map[uint16][]byte
+	if attrs, err = parseAttrs(message.Data[GENL_HDRLEN:]); err != nil {
+		return
+	}
+
+	tokens := make([]string, 0, len(c.Schema))
+	for _, spec := range c.Schema {
+		data, ok := attrs[genlArgAttrs[spec.Name]]
+		if !ok {
+			if spec.Optional {
+				break
+			}
+			return nil, CommandErrorf(syscall.EINVAL, "%s: missing attribute for %s", name, spec.Name)
+		}
+		switch spec.Type {
+		case ARG_INT:
+			var value uint32
+			if value, err = attrU32(data); err != nil {
+				return
+			}
+			tokens = append(tokens, strconv.FormatUint(uint64(value), 10))
+		case ARG_INT_LIST:
+			for len(data) >= 4 {
+				tokens = append(tokens, strconv.FormatUint(uint64(binary.LittleEndian.Uint32(data[:4])), 10))
+				data = data[4:]
+			}
+		case ARG_BOOL:
+			if len(data) < 1 {
+				return nil, &CodecError{Err: ErrShortBuffer, Field: spec.Name, Want: 1, Have: 0}
+			}
+			tokens = append(tokens, strconv.FormatBool(data[0] != 0))
+		default:
+			tokens = append(tokens, attrString(data))
+		}
+	}
+
+	cmd = new(NetlinkCmd)
+	cmd.Cmd = name
+	cmd.Args = strings.Join(tokens, " ")
+	return
+}
+
+// resolveFamily asks the genl controller for the id of gs.Family
+func (gs *GenlSocket) resolveFamily() (err error) {
+	var messages []syscall.NetlinkMessage
+	var destAddr syscall.SockaddrNetlink
+	destAddr.Family = syscall.AF_NETLINK
+
+	attrs := appendAttr(nil, CTRL_ATTR_FAMILY_NAME, append([]byte(gs.Family), 0))
+	request := gs.message(GENL_ID_CTRL, 1, CTRL_CMD_GETFAMILY, attrs)
+	if err = syscall.Sendto(gs.Fd, request, 0, &destAddr); err != nil {
+		return
+	}
+
+	if messages, _, err = recvNetlinkMessages(gs.Fd); err != nil {
+		return
+	}
+	gs.FamilyId, err = parseFamilyReply(gs.Family, messages)
+	return
+}
+
+// parseFamilyReply finds the family id in the controller's answer to
+// CTRL_CMD_GETFAMILY
+func parseFamilyReply(family string, messages []syscall.NetlinkMessage) (id uint16, err error) {
+	for _, message := range messages {
+		switch message.Header.Type {
+		case syscall.NLMSG_ERROR:
+			if len(message.Data) >= 4 {
+				if errno := int32(binary.LittleEndian.Uint32(message.Data[:4])); errno != 0 {
+					return 0, fmt.Errorf("Failed to resolve genl family '%s': %w", family, syscall.Errno(-errno))
+				}
+			}
+		case GENL_ID_CTRL:
+			var ctrlAttrs map[uint16][]byte
+			if len(message.Data) < GENL_HDRLEN {
+				continue
+			}
+			if ctrlAttrs, err = parseAttrs(message.Data[GENL_HDRLEN:]); err != nil {
+				return
+			}
+			if data, ok := ctrlAttrs[CTRL_ATTR_FAMILY_ID]; ok && len(data) >= 2 {
+				return binary.LittleEndian.Uint16(data[:2]), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("No id for genl family '%s' in controller reply", family)
+}
+
+func NewGenlSocket(family string) (gs *GenlSocket, err error) {
+	var fd int
+	if fd, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_GENERIC); err != nil {
+		return
+	}
+	gs = new(GenlSocket)
+	gs.Fd = fd
+	gs.Family = family
+	gs.Addr.Family = syscall.AF_NETLINK
+	// Let the kernel pick the port id so that a reconnect can bind while
+	// the old socket is still open
+	if err = syscall.Bind(fd, &gs.Addr); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	var sa syscall.Sockaddr
+	if sa, err = syscall.Getsockname(fd); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if nl, ok := sa.(*syscall.SockaddrNetlink); ok {
+		gs.Addr.Pid = nl.Pid
+	}
+	if err = setRecvTimeout(fd, RECV_POLL_INTERVAL); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err = gs.resolveFamily(); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	log(fmt.Sprintf("Resolved genl family '%s' to id %d", gs.Family, gs.FamilyId))
+	return
+}
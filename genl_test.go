@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func u32Attr(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for idx, value := range values {
+		binary.LittleEndian.PutUint32(b[4*idx:], value)
+	}
+	return b
+}
+
+func TestGenlAttrRoundTrip(t *testing.T) {
+	// Lengths 5, 4, 1 and 0 exercise the padding to NLA_ALIGNTO
+	want := map[uint16][]byte{
+		GENL_A_CGROUP:  []byte("fg_bg"),
+		GENL_A_PID:     u32Attr(42),
+		GENL_A_FLAG:    {1},
+		GENL_A_TEXT:    {},
+		GENL_A_PIDS:    u32Attr(1, 2, 3),
+		GENL_A_VERSION: u32Attr(2),
+	}
+	var b []byte
+	for _, attrType := range []uint16{GENL_A_CGROUP, GENL_A_PID, GENL_A_FLAG, GENL_A_TEXT, GENL_A_PIDS, GENL_A_VERSION} {
+		b = appendAttr(b, attrType, want[attrType])
+		if len(b)%syscall.NLA_ALIGNTO != 0 {
+			t.Fatalf("attribute %d leaves %d bytes, not aligned", attrType, len(b))
+		}
+	}
+	got, err := parseAttrs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parsed %d attributes, want %d", len(got), len(want))
+	}
+	for attrType, data := range want {
+		if !bytes.Equal(got[attrType], data) {
+			t.Errorf("attribute %d = %v, want %v", attrType, got[attrType], data)
+		}
+	}
+	if s := attrString(append([]byte("bg"), 0, 0)); s != "bg" {
+		t.Errorf("attrString = %q, want \"bg\"", s)
+	}
+	if _, err = attrU32([]byte{1, 2}); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("attrU32 of 2 bytes = %v, want ErrShortBuffer", err)
+	}
+
+	// An attribute claiming more bytes than remain is rejected
+	truncated := appendAttr(nil, GENL_A_TEXT, []byte("truncated"))[:8]
+	if _, err = parseAttrs(truncated); !errors.Is(err, ErrLengthOverflow) {
+		t.Errorf("parseAttrs of a truncated attribute = %v, want ErrLengthOverflow", err)
+	}
+}
+
+func TestGenlDecodeCommand(t *testing.T) {
+	oldCommands := Commands
+	t.Cleanup(func() { Commands = oldCommands })
+	Commands = testRegistry(t)
+	gs := &GenlSocket{FamilyId: 0x20}
+
+	type attr struct {
+		attrType uint16
+		data     []byte
+	}
+	tests := []struct {
+		cmd   uint8
+		attrs []attr
+		want  string
+		errno syscall.Errno
+	}{
+		// Attributes are ordered by the registry schema, not the wire
+		{GENL_CMD_MOVE_TASKS, []attr{{GENL_A_PIDS, u32Attr(7, 8)}, {GENL_A_FLAG, []byte{1}}, {GENL_A_CGROUP, []byte("fg_bg\x00")}}, "move_tasks:fg_bg true 7 8", 0},
+		{GENL_CMD_CPUSET, []attr{{GENL_A_PID, u32Attr(9)}, {GENL_A_CPUSET, []byte("cs_top\x00")}}, "cpuset:cs_top 9", 0},
+		{GENL_CMD_HELLO, []attr{{GENL_A_VERSION, u32Attr(2)}}, "hello:2", 0},
+		{GENL_CMD_CPUSET, []attr{{GENL_A_PID, u32Attr(9)}}, "", syscall.EINVAL},
+		{GENL_CMD_REPLY, nil, "", syscall.EOPNOTSUPP},
+	}
+	for _, test := range tests {
+		var attrs []byte
+		for _, attr := range test.attrs {
+			attrs = appendAttr(attrs, attr.attrType, attr.data)
+		}
+		messages, err := syscall.ParseNetlinkMessage(gs.message(gs.FamilyId, 1, test.cmd, attrs))
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("ParseNetlinkMessage: %d messages, %v", len(messages), err)
+		}
+		cmd, err := gs.DecodeCommand(messages[0])
+		if test.errno != 0 {
+			if ErrnoOf(err) != test.errno {
+				t.Errorf("genl command %d = %v, %v, want errno %d", test.cmd, cmd, err, test.errno)
+			}
+			continue
+		}
+		if err != nil || cmd.String() != test.want {
+			t.Errorf("genl command %d = %v, %v, want %s", test.cmd, cmd, err, test.want)
+		}
+	}
+}
+
+func TestGenlParseFamilyReply(t *testing.T) {
+	ctrl := func(attrs []byte) syscall.NetlinkMessage {
+		m := syscall.NetlinkMessage{Data: append([]byte{CTRL_CMD_GETFAMILY, 2, 0, 0}, attrs...)}
+		m.Header.Type = GENL_ID_CTRL
+		return m
+	}
+	nlError := func(errno syscall.Errno) syscall.NetlinkMessage {
+		m := syscall.NetlinkMessage{Data: u32Attr(uint32(-int32(errno)))}
+		m.Header.Type = syscall.NLMSG_ERROR
+		return m
+	}
+	name := append([]byte(GenlFamilyName), 0)
+
+	id, err := parseFamilyReply(GenlFamilyName, []syscall.NetlinkMessage{
+		ctrl(appendAttr(appendAttr(nil, CTRL_ATTR_FAMILY_NAME, name), CTRL_ATTR_FAMILY_ID, []byte{0x1d, 0})),
+	})
+	if err != nil || id != 0x1d {
+		t.Fatalf("parseFamilyReply = %#x, %v, want 0x1d", id, err)
+	}
+	if _, err = parseFamilyReply(GenlFamilyName, []syscall.NetlinkMessage{nlError(syscall.ENOENT)}); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("parseFamilyReply of an unknown family = %v, want ENOENT", err)
+	}
+	if _, err = parseFamilyReply(GenlFamilyName, []syscall.NetlinkMessage{ctrl(appendAttr(nil, CTRL_ATTR_FAMILY_NAME, name))}); err == nil {
+		t.Error("parseFamilyReply without a family id succeeded")
+	}
+}
+
+func TestGenlCloseTwice(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := &GenlSocket{Fd: fd}
+	if err = gs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The fd number is free again and likely handed out to this socket
+	other, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(other)
+	if err = gs.Close(); !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("second Close = %v, want EBADF", err)
+	}
+	var stat syscall.Stat_t
+	if err = syscall.Fstat(other, &stat); err != nil {
+		t.Fatalf("second Close closed an unrelated fd: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/* KernelSim plays the kernel side of the protocol over the unix transport.
+ * It is driven by a script with one directive per line:
+ *
+ *   send <cmd> [args...]   send a command to the daemon
+ *   reply <cmd> [args...]  send a command carrying the sequence number of
+ *                          the last expected reply, answering a request
+ *   expect <reply>         wait for a matching reply; '*' matches any
+ *                          run of characters and replies may arrive in
+ *                          any order
+ *   sleep <duration>       pause, e.g. sleep 200ms
+ *   timeout <duration>     how long expect waits (default 5s)
+ *   protocol <version>     wire format for sent commands (default 1)
+ *
+ * Blank lines and lines starting with '#' are ignored. Example:
+ *
+ *   expect hello *
+ *   reply hello 1 ack
+ *   send mpdecision 1
+ *   expect ack 1 mpdecision 0 ok
+ *   send move_to_cgroup 1234 bg_non_interactive true
+ *   expect ack 2 move_to_cgroup 0 ok
+ *   send mpdecision 0
+ *   expect ack 3 mpdecision 0 ok
+ */
+type simReply struct {
+	Seq  uint32
+	Text string
+}
+
+type KernelSim struct {
+	Socket  *UnixSocket
+	Codec   *NetlinkCodec
+	Timeout time.Duration
+	seq     uint32
+	lastSeq uint32
+	replies []simReply
+}
+
+func NewKernelSim(simPath string, daemonPath string) (ks *KernelSim, err error) {
+	var us *UnixSocket
+	if us, err = NewUnixSocket(simPath, daemonPath); err != nil {
+		return
+	}
+	ks = new(KernelSim)
+	ks.Socket = us
+	ks.Codec = NewNetlinkCodec(NETLINK_PROTOCOL_V1)
+	ks.Timeout = 5 * time.Second
+	return
+}
+
+func (ks *KernelSim) Close() error {
+	return ks.Socket.Close()
+}
+
+// SendCmd sends cmd framed the way the kernel module does: a bare NlMsghdr
+// followed by the encoded command. A zero cmd.Seq picks the next sequence
+// number of the simulated kernel.
+func (ks *KernelSim) SendCmd(cmd *NetlinkCmd) (err error) {
+	var b []byte
+	if cmd.Seq == 0 {
+		ks.seq++
+		cmd.Seq = ks.seq
+	}
+	if b, err = NewCommand(cmd).Marshal(ks.Codec); err != nil {
+		return
+	}
+
+	log(fmt.Sprintf("kernel-sim: send %v", cmd.String()))
+	return syscall.Sendto(ks.Socket.Fd, b, 0, &ks.Socket.Peer)
+}
+
+// recvReplies queues the next batch of replies sent by the daemon, waiting
+// at most ks.Timeout for it to arrive.
+func (ks *KernelSim) recvReplies() (err error) {
+	var messages []syscall.NetlinkMessage
+
+	if err = setRecvTimeout(ks.Socket.Fd, ks.Timeout); err != nil {
+		return
+	}
+	if messages, _, err = ks.Socket.Recv(); err != nil {
+		if errors.Is(err, syscall.EAGAIN) {
+			err = fmt.Errorf("Timed out after %v waiting for reply", ks.Timeout)
+		}
+		return
+	}
+	for _, message := range messages {
+		var m Message
+		if err = m.Unmarshal(message, MESSAGE_REPLY, ks.Codec); err != nil {
+			return
+		}
+		ks.replies = append(ks.replies, simReply{m.Seq, strings.TrimSpace(m.Text)})
+	}
+	return
+}
+
+// pending lists the text of the replies not matched yet
+func (ks *KernelSim) pending() (texts []string) {
+	for _, reply := range ks.replies {
+		texts = append(texts, reply.Text)
+	}
+	return
+}
+
+// Expect waits for a reply matching want. Handlers run concurrently in the
+// daemon so replies are matched in any order; unmatched ones stay queued.
+func (ks *KernelSim) Expect(want string) (err error) {
+	for {
+		for idx, got := range ks.replies {
+			if matched, _ := path.Match(want, got.Text); matched {
+				ks.replies = append(ks.replies[:idx], ks.replies[idx+1:]...)
+				ks.lastSeq = got.Seq
+				log(fmt.Sprintf("kernel-sim: received expected reply '%s' (seq %d)", got.Text, got.Seq))
+				return
+			}
+		}
+		if err = ks.recvReplies(); err != nil {
+			return fmt.Errorf("Expected reply '%s' (pending: %q): %v", want, ks.pending(), err)
+		}
+	}
+}
+
+func (ks *KernelSim) RunScript(script string) (err error) {
+	var file *os.File
+	if file, err = os.Open(script); err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = ks.runDirective(line); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", script, lineNum, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (ks *KernelSim) runDirective(line string) (err error) {
+	tokens := strings.Fields(line)
+	rest := strings.TrimSpace(strings.TrimPrefix(line, tokens[0]))
+
+	switch tokens[0] {
+	case "send", "reply":
+		if len(tokens) < 2 {
+			return fmt.Errorf("%s needs a command", tokens[0])
+		}
+		cmd := new(NetlinkCmd)
+		cmd.Cmd = tokens[1]
+		cmd.Args = strings.Join(tokens[2:], " ")
+		if tokens[0] == "reply" {
+			cmd.Seq = ks.lastSeq
+		}
+		return ks.SendCmd(cmd)
+	case "expect":
+		return ks.Expect(rest)
+	case "sleep":
+		var d time.Duration
+		if d, err = time.ParseDuration(rest); err != nil {
+			return
+		}
+		time.Sleep(d)
+	case "timeout":
+		if ks.Timeout, err = time.ParseDuration(rest); err != nil {
+			return
+		}
+	case "protocol":
+		var version uint64
+		if version, err = strconv.ParseUint(rest, 10, 32); err != nil {
+			return
+		}
+		ks.Codec = NewNetlinkCodec(uint32(version))
+	default:
+		return fmt.Errorf("Unknown directive: %s", tokens[0])
+	}
+	return
+}
+
+// KernelSimMain runs script against a daemon started with --transport unix
+func KernelSimMain(script string) (err error) {
+	var ks *KernelSim
+	if ks, err = NewKernelSim(UnixPeerPath, UnixSocketPath); err != nil {
+		log("kernel-sim: failed to open socket:", err)
+		return
+	}
+	defer ks.Close()
+
+	if err = ks.RunScript(script); err != nil {
+		log("kernel-sim: FAILED:", err)
+		return
+	}
+	log("kernel-sim: PASSED")
+	return
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,17 +17,95 @@ import (
 )
 
 var (
-	app        *kingpin.Application
-	verbose    *bool
-	LogPathPtr *string
-	bg_cpu     *string
+	app          *kingpin.Application
+	verbose      *bool
+	LogPathPtr   *string
+	bg_cpu       *string
+	transport    *string
+	unixPath     *string
+	unixPeer     *string
+	genlFamily   *string
+	configPath   *string
+	recordPath   *string
+	rootPath     *string
+	pcapPath     *string
+	snapshotPath *string
+
+	nlProtocol      *int
+	nlPortId        *uint32
+	nlBindGroups    *uint32
+	nlGroups        *[]uint32
+	nlDestPort      *uint32
+	nlDestGroup     *uint32
+	nlProtocolSet   bool
+	nlPortIdSet     bool
+	nlBindGroupsSet bool
+	nlGroupsSet     bool
+	nlDestPortSet   bool
+	nlDestGroupSet  bool
+
+	trustedPeers      *[]string
+	workers           *int
+	queueLen          *int
+	queueTimeout      *time.Duration
+	mpdecisionTimeout *time.Duration
+	helloTimeout      *time.Duration
+
+	daemonCmd     *kingpin.CmdClause
+	kernelSimCmd  *kingpin.CmdClause
+	simScript     *string
+	replayCmd     *kingpin.CmdClause
+	replayPath    *string
+	liveReplay    *bool
+	dryRun        *bool
+	snapshotCmd   *kingpin.CmdClause
+	snapshotFile  *string
+	restoreCmd    *kingpin.CmdClause
+	restoreFile   *string
+	restoreDryRun *bool
+	cgroupVersion *string
 )
 
 func init_kingpin() {
 	app = kingpin.New("thermaplan", "Userspace module to manage temperature")
 	verbose = app.Flag("verbose", "Enable verbose output").Short('v').Default("false").Bool()
-	bg_cpu = app.Flag("bg_cpu", "Background cpu").Short('b').Default("0").String()
+	bg_cpu = app.Flag("bg_cpu", "Background cpus; defaults to the slowest online core").Short('b').String()
 	LogPathPtr = app.Flag("log_path", "Log path").Short('l').Default(LogPath).String()
+	transport = app.Flag("transport", "Transport used to talk to the kernel").Short('t').Default(TRANSPORT_NETLINK).Enum(Transports...)
+	unixPath = app.Flag("unix_path", "Unix socket path bound by the daemon (unix transport)").Default(UnixSocketPath).String()
+	unixPeer = app.Flag("unix_peer", "Unix socket path of the simulated kernel (unix transport)").Default(UnixPeerPath).String()
+	genlFamily = app.Flag("genl_family", "Generic netlink family name (genl transport)").Default(GenlFamilyName).String()
+	configPath = app.Flag("config", "JSON config file; flags override its settings").Short('c').String()
+	nlProtocol = app.Flag("netlink_protocol", "Netlink protocol number (netlink transport)").Default(fmt.Sprint(MPDECISION_COEXIST)).IsSetByUser(&nlProtocolSet).Int()
+	nlPortId = app.Flag("netlink_port", "Netlink port id to bind; 0 lets the kernel pick one").Default("0").IsSetByUser(&nlPortIdSet).Uint32()
+	nlBindGroups = app.Flag("netlink_bind_groups", "Multicast group bitmask passed to bind()").Default("0").IsSetByUser(&nlBindGroupsSet).Uint32()
+	nlGroups = app.Flag("netlink_group", "Multicast group to join with NETLINK_ADD_MEMBERSHIP; repeatable").IsSetByUser(&nlGroupsSet).Uint32List()
+	nlDestPort = app.Flag("netlink_dest_port", "Netlink port id replies are sent to").Default("0").IsSetByUser(&nlDestPortSet).Uint32()
+	nlDestGroup = app.Flag("netlink_dest_group", "Multicast group replies are sent to").Default("1").IsSetByUser(&nlDestGroupSet).Uint32()
+	cgroupVersion = app.Flag("cgroup", "cgroup version; auto detects it from /proc/mounts").Enum(CgroupVersions...)
+	rootPath = app.Flag("root", "Prefix for every sysfs, procfs and cgroup path").String()
+	recordPath = app.Flag("record", "Record kernel commands and replies to this JSON-lines file").String()
+	pcapPath = app.Flag("pcap", "Capture kernel traffic to this pcap file (LINKTYPE_NETLINK)").String()
+	snapshotPath = app.Flag("snapshot", "Snapshot the cgroups to this file at startup and restore it on shutdown").String()
+	trustedPeers = app.Flag("trusted_peer", "Userspace sender allowed to issue commands (port:<id>, path:<path> or uid:<uid>); repeatable").Strings()
+	workers = app.Flag("workers", "Number of workers handling kernel commands").Default("4").Int()
+	queueLen = app.Flag("queue_len", "Pending commands per worker before back-pressure").Default("64").Int()
+	helloTimeout = app.Flag("hello_timeout", "How long to wait for the kernel's hello reply").Default("1s").Duration()
+	queueTimeout = app.Flag("queue_timeout", "How long a full queue blocks before the command is dropped").Default("100ms").Duration()
+	mpdecisionTimeout = app.Flag("mpdecision_timeout", "How long an mpdecision request waits for a block or unblock to finish").Default(MPDECISION_TIMEOUT.String()).Duration()
+
+	daemonCmd = app.Command("daemon", "Run the daemon").Default()
+	kernelSimCmd = app.Command("kernel-sim", "Act as the kernel and drive a daemon started with --transport unix")
+	simScript = kernelSimCmd.Arg("script", "Script of commands and expected replies").Required().String()
+	replayCmd = app.Command("replay", "Run the commands of a recording through the handlers")
+	replayPath = replayCmd.Arg("recording", "File written with --record").Required().String()
+	liveReplay = replayCmd.Flag("live", "Replay against the real cgroup and sysfs files instead of an in-memory tree").Bool()
+	dryRun = replayCmd.Flag("dry_run", "With --live, log file writes instead of doing them").Bool()
+	snapshotCmd = app.Command("snapshot", "Save the cpuset and cpuctl hierarchies to a JSON file")
+	snapshotFile = snapshotCmd.Arg("file", "Snapshot file to write").Required().String()
+	restoreCmd = app.Command("restore", "Restore the cpuset and cpuctl hierarchies from a snapshot")
+	restoreFile = restoreCmd.Arg("file", "File written by snapshot or --snapshot").Required().String()
+	restoreDryRun = restoreCmd.Flag("dry_run", "Log file writes instead of doing them").Bool()
 }
 
 type FsNotifyHandler func(Container *InotifyContainer)
@@ -40,69 +121,116 @@ type InotifyContainer struct {
 
 var bgCgroupHandlerStarted bool = false
 
-func NetlinkRecvHandler() {
+// RunCommand dispatches cmd and acknowledges the outcome to the kernel
+func RunCommand(sender *NetlinkSender, cmd *NetlinkCmd) {
+	err := Commands.Dispatch(sender, cmd)
+	if err != nil {
+		log(fmt.Sprintf("Command %v failed: %v", cmd.String(), err))
+	}
+	if err = SendAck(sender, cmd, err); err != nil {
+		log(fmt.Sprintf("Failed to acknowledge %v: %v", cmd.String(), err))
+	}
+}
+
+// Connector opens a fresh transport and is used to recover from fatal
+// socket errors. Handshake is redone after every reconnect; it must start
+// the exchange in the background and return.
+type Connector func() (SocketInterface, error)
+
+func NetlinkRecvHandler(ctx context.Context, sender *NetlinkSender, dispatcher *Dispatcher, connect Connector, handshake func()) {
 	var messages []syscall.NetlinkMessage
+	var peer *Peer
 	var err error
 
+	backoff := NewBackoff(10*time.Millisecond, 5*time.Second)
+
 	log("Starting NetlinkRecvHandler()")
-	for {
-		log("recvHandler loop")
-		if messages, err = Socket.Recv(); err != nil {
-			log("Failed recv:", err)
+	for ctx.Err() == nil {
+		if messages, peer, err = sender.Recv(); err != nil {
+			class := ClassifyRecvError(err)
+			switch class {
+			case RECV_ERR_TIMEOUT, RECV_ERR_RETRY:
+				continue
+			case RECV_ERR_OVERRUN:
+				log("Socket overrun, messages from kernel were lost:", err)
+				if err = RequestResync(sender); err != nil {
+					log("Failed to request resync:", err)
+				}
+				continue
+			case RECV_ERR_FATAL:
+				log("Failed recv, reconnecting:", err)
+				for ctx.Err() == nil {
+					var socket SocketInterface
+					if socket, err = connect(); errors.Is(err, syscall.EADDRINUSE) {
+						// A configured port stays taken until the broken
+						// socket is closed
+						sender.Close()
+						socket, err = connect()
+					}
+					if err == nil {
+						sender.Reset(socket).Close()
+						handshake()
+						break
+					}
+					log("Reconnect failed:", err)
+					sleepContext(ctx, backoff.Next())
+				}
+			default:
+				log(fmt.Sprintf("Failed recv (%v): %v", class, err))
+				sleepContext(ctx, backoff.Next())
+			}
+			continue
 		}
-		for m := range messages {
-			message := messages[m]
-
-			pos := 0
-			real_len := binary.LittleEndian.Uint32(message.Data[:pos+4])
-			_ = real_len
-			log("Real len:", real_len)
-			pos += 4
+		backoff.Reset()
 
-			cmdLen := binary.LittleEndian.Uint32(message.Data[pos : pos+4])
-			log("cmdLen:", cmdLen)
-			pos += 4
-
-			cmdBytes := message.Data[pos : pos+NETLINK_CMD_SIZE]
-			command := strings.TrimSpace(string(cmdBytes[:cmdLen]))
-			log("command:", command)
-			pos += NETLINK_CMD_SIZE
+		if !TrustedPeers.Check(peer) {
+			continue
+		}
 
-			argsLen := binary.LittleEndian.Uint32(message.Data[pos : pos+4])
-			log("argsLen:", argsLen)
-			pos += 4
+		for m := range messages {
+			message := messages[m]
 
-			argsBytes := message.Data[pos : pos+NETLINK_ARGS_SIZE]
-			args := strings.TrimSpace(string(argsBytes[:argsLen]))
-			log("args:", args)
-			pos += NETLINK_ARGS_SIZE
+			switch message.Header.Type {
+			case syscall.NLMSG_NOOP, syscall.NLMSG_DONE:
+				continue
+			case syscall.NLMSG_ERROR:
+				log("Kernel reported a netlink error")
+				continue
+			}
 
-			cmd := new(NetlinkCmd)
-			cmd.Cmd = command
-			cmd.Args = args
+			cmd, err := sender.Decode(message)
+			if err != nil {
+				log("Dropping malformed message:", err)
+				continue
+			}
+			cmd.Seq = message.Header.Seq
+			Recording.Inbound(cmd)
 
 			log(fmt.Sprintf("Command: %v", cmd.String()))
 
-			switch cmd.Cmd {
-			case "mpdecision":
-				go MpdecisionHandler(cmd)
-			case "move_to_cgroup":
-				go MoveToCgroupHandler(cmd)
-			case "cpuset":
-				go CpusetHandler(cmd)
-			default:
-				log(fmt.Sprintf("Unknown command: %v", cmd.String()))
+			if cmd.Cmd == "hello" {
+				// Capabilities decide how the commands behind this one are
+				// answered, so apply them before dispatching anything else
+				if err = Commands.Dispatch(sender, cmd); err != nil {
+					log("Failed to apply hello:", err)
+				}
+				sender.Deliver(cmd)
+				continue
+			}
+			if sender.Deliver(cmd) {
+				continue
+			}
+			if err = dispatcher.Submit(sender, cmd); err != nil {
+				SendAck(sender, cmd, err)
 			}
 		}
 	}
-	goto out
-out:
 	log("Finished NetlinkRecvHandler()")
 }
 
 func FgBgMigrationHandler(container *InotifyContainer) {
-	fgBgCgroupTfPath := "/dev/cpuctl/fg_bg/tasks"
-	bgCgroupTfPath := "/dev/cpuctl/bg_non_interactive/tasks"
+	fgBgCgroupTfPath := Cgroups.CgroupTasks(FG_BG_CGROUP)
+	bgCgroupTfPath := Cgroups.CgroupTasks(BG_CGROUP)
 
 	log("Starting watcher: FgBgMigration")
 
@@ -115,7 +243,7 @@ func FgBgMigrationHandler(container *InotifyContainer) {
 }
 
 func BgCgroupHandler(container *InotifyContainer) {
-	bgCpusetTasksFile := "/sys/fs/cgroup/cpuset/cs_bg_non_interactive/tasks"
+	bgCpusetTasksFile := Cgroups.CpusetTasks(CgroupCpuset(BG_CGROUP))
 
 	if bgCgroupHandlerStarted {
 		return
@@ -150,58 +278,263 @@ func AddWatcher(container *InotifyContainer) (err error) {
 	return
 }
 
-var (
-	isBlocked  = false
-	signalChan = make(chan struct{}, 0)
-)
-
 func Process() (err error) {
 	/*
 		// XXX: Currently, mpdecision upcall handler does not work as expected
 		// sysfs_notify is not making its way to fsnotify
 		mpdecisionUpcallContainer := new(InotifyContainer)
-		mpdecisionUpcallContainer.FilePath = "/sys/tempfreq/mpdecision_coexist_upcall"
+		mpdecisionUpcallContainer.FilePath = Settings.Paths.Tempfreq("mpdecision_coexist_upcall")
 		mpdecisionUpcallContainer.NotifyChannel = make(chan struct{}, 0)
 		mpdecisionUpcallContainer.Handler = MpdecisionCoexistUpcallHandler
 		AddWatcher(mpdecisionUpcallContainer)
 	*/
 	/*
 		FgBgMigrationContainer := new(InotifyContainer)
-		FgBgMigrationContainer.FilePath = "/proc/foreground"
+		FgBgMigrationContainer.FilePath = Settings.Paths.Proc("foreground")
 		FgBgMigrationContainer.NotifyChannel = make(chan struct{}, 0)
 		FgBgMigrationContainer.Handler = FgBgMigrationHandler
 		AddWatcher(FgBgMigrationContainer)
 	*/
-	bgCpu := *bg_cpu
-	write("/sys/tempfreq/mpdecision_bg_cpu", bgCpu)
+	var topology *Topology
+	if topology, err = DiscoverTopology(); err != nil {
+		log(err)
+		return
+	}
+	log("Cpu topology:", topology)
+	if *bg_cpu == "" {
+		var slowest int
+		if slowest, err = topology.SlowestCore(); err != nil {
+			log(err)
+			return
+		}
+		*bg_cpu = strconv.Itoa(slowest)
+	}
+
+	// Reject a bad --bg_cpu before any cgroup is touched
+	var bgCpu CpuList
+	if bgCpu, err = ParseValidCpuList(*bg_cpu); err != nil {
+		log("Invalid --bg_cpu:", err)
+		return
+	}
+	if bgCpu.IsEmpty() {
+		err = fmt.Errorf("--bg_cpu must name at least one cpu")
+		log(err)
+		return
+	}
+
+	if Cgroups, err = DetectCgroupBackend(Settings.Cgroup); err != nil {
+		log(err)
+		return
+	}
+	log(fmt.Sprintf("Using cgroup %s", Cgroups.Version()))
+	if *snapshotPath != "" {
+		var snapshot *CgroupSnapshot
+		if snapshot, err = DaemonSnapshot(*snapshotPath); err != nil {
+			log("Failed to snapshot cgroups:", err)
+			return
+		}
+		defer RestoreDaemonSnapshot(snapshot, *snapshotPath)
+	}
+	if err = Cpusets.EnsureCpusets(Settings.Cpusets); err != nil {
+		log("Failed to set up cpusets:", err)
+		return
+	}
+	Mpdecision.Timeout = *mpdecisionTimeout
+
+	write(Settings.Paths.Tempfreq("mpdecision_bg_cpu"), bgCpu)
 	log("Informed kernel that background cpu is:", bgCpu)
 
-	if err = InitializeNetlinkConnection(); err != nil {
+	if err = RegisterCommands(Commands); err != nil {
+		log("Failed to register commands:", err)
 		return
 	}
-	go NetlinkRecvHandler()
+
+	for _, entry := range *trustedPeers {
+		if err = TrustedPeers.Allow(entry); err != nil {
+			log(err)
+			return
+		}
+	}
+	if *transport == TRANSPORT_UNIX {
+		// The simulated kernel is a userspace process
+		TrustedPeers.Allow("path:" + UnixPeerPath)
+	}
+
+	if *recordPath != "" {
+		if Recording, err = NewRecorder(*recordPath); err != nil {
+			log(fmt.Sprintf("Failed to open recording '%s': %v", *recordPath, err))
+			return
+		}
+		defer Recording.Close()
+	}
+
+	if *pcapPath != "" {
+		if Capture, err = NewPcapWriter(*pcapPath); err != nil {
+			log(fmt.Sprintf("Failed to open pcap '%s': %v", *pcapPath, err))
+			return
+		}
+		defer Capture.Close()
+	}
+
+	connect := func() (SocketInterface, error) {
+		return NewTransport(*transport)
+	}
+	var socket SocketInterface
+	if socket, err = connect(); err != nil {
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	dispatcher := NewDispatcher(Commands, *workers, *queueLen, *queueTimeout, RunCommand)
+	sender := NewNetlinkSender(socket)
+	// Each handshake cancels the one before it, so reconnects while the
+	// kernel is unreachable do not pile up retry loops
+	var handshakes sync.WaitGroup
+	var handshakeMutex sync.Mutex
+	cancelHandshake := context.CancelFunc(func() {})
+	handshake := func() {
+		handshakeMutex.Lock()
+		defer handshakeMutex.Unlock()
+		cancelHandshake()
+		var handshakeCtx context.Context
+		handshakeCtx, cancelHandshake = context.WithCancel(ctx)
+		handshakes.Add(1)
+		go func() {
+			defer handshakes.Done()
+			if err := InitializeNetlinkConnection(handshakeCtx, sender, HandledCommands(), *helloTimeout); err != nil && handshakeCtx.Err() == nil {
+				log("Handshake failed:", err)
+			}
+		}()
+	}
+
+	recvDone := make(chan struct{})
+	go func() {
+		NetlinkRecvHandler(ctx, sender, dispatcher, connect, handshake)
+		close(recvDone)
+	}()
+	handshake()
 	//go MpdecisionCoexistHandler()
 
-	tmp := make(chan struct{}, 0)
-	<-tmp
+	<-ctx.Done()
+	log("Shutting down")
+	<-recvDone
+	handshakeMutex.Lock()
+	cancelHandshake()
+	handshakeMutex.Unlock()
+	handshakes.Wait()
+	dispatcher.Stop()
+	sender.Close()
+	return
+}
+
+// loadSettings reads --config, if given, and applies the flags set on the
+// command line on top of it
+func loadSettings() (err error) {
+	if *configPath != "" {
+		if Settings, err = LoadConfig(*configPath); err != nil {
+			return
+		}
+	}
+	if *cgroupVersion != "" {
+		Settings.Cgroup = *cgroupVersion
+	}
+	if *rootPath != "" {
+		Settings.Paths.Root = *rootPath
+	}
+	if nlProtocolSet {
+		Settings.Netlink.Protocol = *nlProtocol
+	}
+	if nlPortIdSet {
+		Settings.Netlink.PortId = *nlPortId
+	}
+	if nlBindGroupsSet {
+		Settings.Netlink.BindGroups = *nlBindGroups
+	}
+	if nlGroupsSet {
+		Settings.Netlink.Groups = *nlGroups
+	}
+	if nlDestPortSet {
+		Settings.Netlink.DestPort = *nlDestPort
+	}
+	if nlDestGroupSet {
+		Settings.Netlink.DestGroup = *nlDestGroup
+	}
 	return
 }
 
 func Main(argv []string) {
 	init_kingpin()
 
-	if _, err := app.Parse(argv[1:]); err != nil {
+	command, err := app.Parse(argv[1:])
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
 	LogPath = *LogPathPtr
+	UnixSocketPath = *unixPath
+	UnixPeerPath = *unixPeer
+	GenlFamilyName = *genlFamily
+	if err = loadSettings(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	init_logger()
 
-	log("verbose:", *verbose)
-	log("bg_cpu:", *bg_cpu)
-
-	Process()
+	switch command {
+	case kernelSimCmd.FullCommand():
+		if err = KernelSimMain(*simScript); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case replayCmd.FullCommand():
+		DryRun = *dryRun
+		// Commands from another device must not move tasks on this one
+		// unless asked to
+		if !*liveReplay {
+			version := Settings.Cgroup
+			if version == CGROUP_AUTO {
+				version = CGROUP_V1
+			}
+			mfs := NewLayoutMemFS(&Settings.Paths, version)
+			mfs.AnyPid = true
+			Fs = mfs
+			log("replay: using an in-memory cgroup tree, pass --live to use the real one")
+		}
+		if Cgroups, err = DetectCgroupBackend(Settings.Cgroup); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err = ReplayMain(*replayPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case snapshotCmd.FullCommand(), restoreCmd.FullCommand():
+		if Cgroups, err = DetectCgroupBackend(Settings.Cgroup); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if command == snapshotCmd.FullCommand() {
+			err = SnapshotMain(*snapshotFile)
+		} else {
+			DryRun = *restoreDryRun
+			err = RestoreMain(*restoreFile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case daemonCmd.FullCommand():
+		log("verbose:", *verbose)
+		log("bg_cpu:", *bg_cpu)
+		log("transport:", *transport)
+		log(fmt.Sprintf("netlink: %+v", Settings.Netlink))
+		log("workers:", *workers)
+
+		Process()
+	}
 }
 
 func main() {
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* MemFS is an in-memory FS that behaves like cgroupfs where the handlers
+ * rely on it:
+ *
+ *   - directories made with Mkdir below a hierarchy mounted with
+ *     MountCgroup or MountCgroup2 get the hierarchy's control files
+ *   - "tasks" (v1) and cgroup.procs/cgroup.threads (v2) take one pid per
+ *     write, anything else fails with EINVAL; a pid written to a cgroup
+ *     leaves the cgroup it was in, and reading them lists the current
+ *     members one per line
+ *   - unknown pids fail with ESRCH unless AnyPid is set
+ *   - joining a v1 cpuset whose cpuset.cpus or cpuset.mems is empty fails
+ *     with EINVAL; v2 cpusets inherit from their parent instead
+ *   - removing a cgroup that still has tasks fails with EBUSY
+ *   - below a dir given to MountProc, <pid>/cpuset names the cpuset of
+ *     each live pid and <pid>/stat gives its start time like /proc does
+ *
+ * Any other file is plain data and must be made with Create first.
+ */
+type memCgroupKind int
+
+const (
+	memCgroupV1 memCgroupKind = iota
+	memCpusetV1
+	memCgroupV2
+)
+
+type MemFS struct {
+	mutex  sync.Mutex
+	files  map[string][]byte
+	dirs   map[string]bool
+	mounts map[string]memCgroupKind
+	tasks  map[string]string
+	// pids maps live pids to their start time
+	pids   map[int]uint64
+	clock  uint64
+	proc   string
+	AnyPid bool
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files:  make(map[string][]byte),
+		dirs:   map[string]bool{"/": true},
+		mounts: make(map[string]memCgroupKind),
+		tasks:  make(map[string]string),
+		pids:   make(map[int]uint64),
+	}
+}
+
+func memPathError(op string, path string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: path, Err: errno}
+}
+
+// AddPid makes pid a live process that starts in the root of every
+// hierarchy. Each call gives pid a later start time.
+func (mfs *MemFS) AddPid(pid int) {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	mfs.startPid(pid)
+	for root := range mfs.mounts {
+		if _, ok := mfs.tasks[mfs.taskKey(root, pid)]; !ok {
+			mfs.tasks[mfs.taskKey(root, pid)] = root
+		}
+	}
+}
+
+// RemovePid makes pid exit, leaving every cgroup
+func (mfs *MemFS) RemovePid(pid int) {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	delete(mfs.pids, pid)
+	for root := range mfs.mounts {
+		delete(mfs.tasks, mfs.taskKey(root, pid))
+	}
+}
+
+func (mfs *MemFS) startPid(pid int) {
+	mfs.clock++
+	mfs.pids[pid] = mfs.clock
+}
+
+func (mfs *MemFS) taskKey(root string, pid int) string {
+	return root + "\x00" + strconv.Itoa(pid)
+}
+
+func (mfs *MemFS) mkdirAll(path string) {
+	for dir := filepath.Clean(path); !mfs.dirs[dir]; dir = filepath.Dir(dir) {
+		mfs.dirs[dir] = true
+	}
+}
+
+// Create makes a plain file holding data, along with its parent directories
+func (mfs *MemFS) Create(path string, data string) {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	mfs.mkdirAll(filepath.Dir(path))
+	mfs.files[path] = []byte(data)
+}
+
+// MountCgroup makes path the root of a cgroup v1 hierarchy. cpuset
+// hierarchies get cpuset.cpus and cpuset.mems in every cgroup.
+func (mfs *MemFS) MountCgroup(path string, cpuset bool) {
+	kind := memCgroupV1
+	if cpuset {
+		kind = memCpusetV1
+	}
+	mfs.mount(path, kind)
+}
+
+// MountCgroup2 makes path the root of a unified hierarchy with the cpu and
+// cpuset controllers enabled
+func (mfs *MemFS) MountCgroup2(path string) {
+	mfs.mount(path, memCgroupV2)
+}
+
+// MountProc makes path the procfs for <pid>/cpuset
+func (mfs *MemFS) MountProc(path string) {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	mfs.proc = filepath.Clean(path)
+	mfs.mkdirAll(mfs.proc)
+}
+
+// procFile is the contents of <proc>/<pid>/cpuset, the cpuset of pid
+// relative to the root of the cpuset or unified hierarchy, and of
+// <proc>/<pid>/stat, which only fills in the start time
+func (mfs *MemFS) procFile(path string) (data []byte, ok bool, err error) {
+	if mfs.proc == "" || filepath.Dir(filepath.Dir(path)) != mfs.proc {
+		return nil, false, nil
+	}
+	name := filepath.Base(path)
+	pid, e := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+	if e != nil || (name != "cpuset" && name != "stat") {
+		return nil, false, nil
+	}
+	if mfs.pids[pid] == 0 {
+		return nil, true, memPathError("open", path, syscall.ENOENT)
+	}
+	if name == "stat" {
+		fields := make([]string, PROC_STAT_FIELDS)
+		for idx := range fields {
+			fields[idx] = "0"
+		}
+		fields[0], fields[1], fields[2] = strconv.Itoa(pid), "(memfs)", "S"
+		fields[PROC_STAT_STARTTIME-1] = strconv.FormatUint(mfs.pids[pid], 10)
+		return []byte(strings.Join(fields, " ") + "\n"), true, nil
+	}
+	for root, kind := range mfs.mounts {
+		if kind != memCpusetV1 && kind != memCgroupV2 {
+			continue
+		}
+		rel, _ := filepath.Rel(root, mfs.tasks[mfs.taskKey(root, pid)])
+		return []byte(filepath.Join("/", rel) + "\n"), true, nil
+	}
+	return nil, true, memPathError("open", path, syscall.ENOENT)
+}
+
+func (mfs *MemFS) mount(path string, kind memCgroupKind) {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	mfs.mkdirAll(path)
+	mfs.mounts[path] = kind
+	mfs.addControlFiles(path, kind)
+	for pid := range mfs.pids {
+		mfs.tasks[mfs.taskKey(path, pid)] = path
+	}
+}
+
+func (mfs *MemFS) addControlFiles(dir string, kind memCgroupKind) {
+	switch kind {
+	case memCgroupV1:
+		mfs.files[filepath.Join(dir, CPUSET_TASKS)] = nil
+		mfs.files[filepath.Join(dir, CPU_SHARES)] = []byte("1024\n")
+	case memCpusetV1:
+		mfs.files[filepath.Join(dir, CPUSET_TASKS)] = nil
+		mfs.files[filepath.Join(dir, CPUSET_CPUS)] = nil
+		mfs.files[filepath.Join(dir, CPUSET_MEMS)] = nil
+		mfs.files[filepath.Join(dir, CPUSET_CPU_EXCLUSIVE)] = []byte("0\n")
+	case memCgroupV2:
+		mfs.files[filepath.Join(dir, CGROUP_PROCS)] = nil
+		mfs.files[filepath.Join(dir, CGROUP_THREADS)] = nil
+		mfs.files[filepath.Join(dir, CGROUP_TYPE)] = []byte("domain\n")
+		mfs.files[filepath.Join(dir, CPUSET_CPUS)] = nil
+		mfs.files[filepath.Join(dir, CPUSET_MEMS)] = nil
+		mfs.files[filepath.Join(dir, CPU_WEIGHT)] = []byte("100\n")
+		mfs.files[filepath.Join(dir, CPUSET_PARTITION)] = []byte("member\n")
+	}
+}
+
+func isTasksFile(kind memCgroupKind, name string) bool {
+	if kind == memCgroupV2 {
+		return name == CGROUP_PROCS || name == CGROUP_THREADS
+	}
+	return name == CPUSET_TASKS
+}
+
+// hierarchy returns the mount path lies under
+func (mfs *MemFS) hierarchy(path string) (root string, kind memCgroupKind, ok bool) {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if kind, ok = mfs.mounts[dir]; ok {
+			return dir, kind, true
+		}
+		if dir == "/" || dir == "." {
+			return "", 0, false
+		}
+	}
+}
+
+func (mfs *MemFS) members(cgroup string) (pids []int) {
+	root, _, _ := mfs.hierarchy(cgroup)
+	for pid := range mfs.pids {
+		if mfs.tasks[mfs.taskKey(root, pid)] == cgroup {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return
+}
+
+func (mfs *MemFS) Open(path string) (io.ReadCloser, error) {
+	data, err := mfs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (mfs *MemFS) ReadFile(path string) ([]byte, error) {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	if data, ok, err := mfs.procFile(path); ok {
+		return data, err
+	}
+	data, ok := mfs.files[path]
+	if !ok {
+		if mfs.dirs[path] {
+			return nil, memPathError("read", path, syscall.EISDIR)
+		}
+		return nil, memPathError("open", path, syscall.ENOENT)
+	}
+	if _, kind, ok := mfs.hierarchy(path); ok && isTasksFile(kind, filepath.Base(path)) {
+		var buf bytes.Buffer
+		for _, pid := range mfs.members(filepath.Dir(path)) {
+			fmt.Fprintf(&buf, "%d\n", pid)
+		}
+		return buf.Bytes(), nil
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (mfs *MemFS) WriteFile(path string, data []byte) error {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	if _, ok := mfs.files[path]; !ok {
+		return memPathError("open", path, syscall.ENOENT)
+	}
+	if root, kind, ok := mfs.hierarchy(path); ok && isTasksFile(kind, filepath.Base(path)) {
+		return mfs.writeTasks(path, root, kind, data)
+	}
+	mfs.files[path] = append([]byte(nil), data...)
+	return nil
+}
+
+func (mfs *MemFS) writeTasks(path string, root string, kind memCgroupKind, data []byte) error {
+	cgroup := filepath.Dir(path)
+	if kind == memCpusetV1 && cgroup != root {
+		if len(bytes.TrimSpace(mfs.files[filepath.Join(cgroup, CPUSET_CPUS)])) == 0 ||
+			len(bytes.TrimSpace(mfs.files[filepath.Join(cgroup, CPUSET_MEMS)])) == 0 {
+			return memPathError("write", path, syscall.EINVAL)
+		}
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid < 0 {
+		return memPathError("write", path, syscall.EINVAL)
+	}
+	if mfs.pids[pid] == 0 {
+		if !mfs.AnyPid {
+			return memPathError("write", path, syscall.ESRCH)
+		}
+		mfs.startPid(pid)
+	}
+	mfs.tasks[mfs.taskKey(root, pid)] = cgroup
+	return nil
+}
+
+func (mfs *MemFS) Mkdir(path string) error {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	if mfs.dirs[path] {
+		return memPathError("mkdir", path, syscall.EEXIST)
+	}
+	if !mfs.dirs[filepath.Dir(path)] {
+		return memPathError("mkdir", path, syscall.ENOENT)
+	}
+	mfs.dirs[path] = true
+	if _, kind, ok := mfs.hierarchy(path); ok {
+		mfs.addControlFiles(path, kind)
+	}
+	return nil
+}
+
+func (mfs *MemFS) Remove(path string) error {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	if _, ok := mfs.files[path]; ok {
+		if _, _, ok := mfs.hierarchy(path); ok {
+			// cgroup control files cannot be removed
+			return memPathError("remove", path, syscall.EPERM)
+		}
+		delete(mfs.files, path)
+		return nil
+	}
+	if !mfs.dirs[path] {
+		return memPathError("remove", path, syscall.ENOENT)
+	}
+	if _, isRoot := mfs.mounts[path]; isRoot {
+		return memPathError("remove", path, syscall.EBUSY)
+	}
+	_, _, isCgroup := mfs.hierarchy(path)
+	if isCgroup && len(mfs.members(path)) > 0 {
+		return memPathError("remove", path, syscall.EBUSY)
+	}
+	prefix := path + "/"
+	for dir := range mfs.dirs {
+		if strings.HasPrefix(dir, prefix) {
+			return memPathError("remove", path, syscall.ENOTEMPTY)
+		}
+	}
+	for file := range mfs.files {
+		if strings.HasPrefix(file, prefix) {
+			if !isCgroup {
+				return memPathError("remove", path, syscall.ENOTEMPTY)
+			}
+			delete(mfs.files, file)
+		}
+	}
+	delete(mfs.dirs, path)
+	return nil
+}
+
+func (mfs *MemFS) Stat(path string) (os.FileInfo, error) {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	if data, ok := mfs.files[path]; ok {
+		return &memFileInfo{name: filepath.Base(path), size: int64(len(data))}, nil
+	}
+	if mfs.dirs[path] {
+		return &memFileInfo{name: filepath.Base(path), dir: true}, nil
+	}
+	return nil, memPathError("stat", path, syscall.ENOENT)
+}
+
+func (mfs *MemFS) ReadDir(path string) (names []string, err error) {
+	mfs.mutex.Lock()
+	defer mfs.mutex.Unlock()
+	path = filepath.Clean(path)
+	if !mfs.dirs[path] {
+		if _, ok := mfs.files[path]; ok {
+			return nil, memPathError("readdir", path, syscall.ENOTDIR)
+		}
+		return nil, memPathError("open", path, syscall.ENOENT)
+	}
+	for dir := range mfs.dirs {
+		if dir != path && filepath.Dir(dir) == path {
+			names = append(names, filepath.Base(dir))
+		}
+	}
+	for file := range mfs.files {
+		if filepath.Dir(file) == path {
+			names = append(names, filepath.Base(file))
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi *memFileInfo) Name() string { return fi.name }
+func (fi *memFileInfo) Size() int64  { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+func (fi *memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+// NewLayoutMemFS returns a MemFS populated with the cgroups and sysfs files
+// the daemon expects under layout, using cgroup v1 or v2 and listing the
+// hierarchies in /proc/mounts
+func NewLayoutMemFS(layout *PathLayout, version string) *MemFS {
+	var mounts string
+	mfs := NewMemFS()
+	switch version {
+	case CGROUP_V2:
+		root := layout.resolve(layout.Cgroup2Dir)
+		mfs.MountCgroup2(root)
+		for _, cgroup := range []string{BG_CGROUP, FG_BG_CGROUP} {
+			mfs.Mkdir(filepath.Join(root, cgroup))
+		}
+		mounts = fmt.Sprintf("cgroup2 %s cgroup2 rw,nosuid,nodev,noexec,relatime 0 0\n", layout.Cgroup2Dir)
+	default:
+		mfs.MountCgroup(layout.Cpuset(CPUSET_DEFAULT), true)
+		mfs.MountCgroup(layout.resolve(layout.CpuctlDir), false)
+		for _, cgroup := range []string{BG_CGROUP, FG_BG_CGROUP} {
+			mfs.Mkdir(layout.Cpuset(CgroupCpuset(cgroup)))
+			mfs.Mkdir(filepath.Dir(layout.CgroupTasks(cgroup)))
+		}
+		mounts = fmt.Sprintf("cgroup %s cgroup rw,relatime,cpuset 0 0\ncgroup %s cgroup rw,relatime,cpu 0 0\n", layout.CpusetDir, layout.CpuctlDir)
+	}
+	mfs.MountProc(layout.resolve(layout.ProcDir))
+	mfs.Create(layout.Proc("mounts"), mounts)
+	mfs.Create(layout.Proc(PROC_BOOT_ID), "6d2c53d4-3c1b-4a52-9d0e-2f5b1a7c9e10\n")
+	mfs.Create(layout.Cpu("possible"), "0-3\n")
+	mfs.Create(layout.Cpu("online"), "0-3\n")
+	for cpu := 0; cpu < 4; cpu++ {
+		mfs.Create(layout.CpuFile(cpu, "topology/core_id"), fmt.Sprintf("%d\n", cpu))
+		mfs.Create(layout.CpuFile(cpu, "topology/physical_package_id"), "0\n")
+		mfs.Create(layout.CpuFile(cpu, "topology/core_siblings_list"), "0-3\n")
+		mfs.Create(layout.CpuFile(cpu, "cpufreq/related_cpus"), "0-3\n")
+		mfs.Create(layout.CpuFile(cpu, "cpufreq/cpuinfo_max_freq"), "2265600\n")
+	}
+	mfs.Create(layout.Tempfreq("mpdecision_bg_cpu"), "0")
+	mfs.Create(layout.Tempfreq("mpdecision_coexist_upcall"), "0")
+	return mfs
+}
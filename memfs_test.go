@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// useMemFS points Fs and Settings at a fresh NewLayoutMemFS for the test,
+// and Cgroups at the backend of version
+func useMemFS(t *testing.T, version string) *MemFS {
+	oldFs, oldSettings, oldCgroups := Fs, Settings, Cgroups
+	t.Cleanup(func() { Fs, Settings, Cgroups = oldFs, oldSettings, oldCgroups })
+	Settings = DefaultConfig()
+	mfs := NewLayoutMemFS(&Settings.Paths, version)
+	Fs = mfs
+	Cgroups = CgroupV1{}
+	if version == CGROUP_V2 {
+		Cgroups = CgroupV2{}
+	}
+	return mfs
+}
+
+func readString(t *testing.T, path string) string {
+	b, err := Fs.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestMemFSTasks(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V1)
+	layout := &Settings.Paths
+	bgTasks := layout.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_TASKS)
+	rootTasks := layout.CpusetFile(CPUSET_DEFAULT, CPUSET_TASKS)
+	mfs.AddPid(10)
+	mfs.AddPid(11)
+
+	tests := []struct {
+		name  string
+		path  string
+		data  string
+		setup func()
+		want  error
+	}{
+		{"unknown pid", rootTasks, "99", nil, syscall.ESRCH},
+		{"empty cpuset", bgTasks, "10", nil, syscall.EINVAL},
+		{"not a pid", rootTasks, "ten", nil, syscall.EINVAL},
+		{"two pids in one write", rootTasks, "10\n11", nil, syscall.EINVAL},
+		{"cpuset with cpus and mems", bgTasks, "10\n", func() {
+			mfs.WriteFile(layout.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_CPUS), []byte("0"))
+			mfs.WriteFile(layout.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_MEMS), []byte("0"))
+		}, nil},
+		{"missing file", "/nope", "10", nil, os.ErrNotExist},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.setup != nil {
+				test.setup()
+			}
+			if err := Fs.WriteFile(test.path, []byte(test.data)); !errors.Is(err, test.want) {
+				t.Fatalf("WriteFile(%s, %q) = %v, want %v", test.path, test.data, err, test.want)
+			}
+		})
+	}
+
+	if got := readString(t, bgTasks); got != "10\n" {
+		t.Fatalf("bg tasks = %q, want \"10\\n\"", got)
+	}
+	if got := readString(t, rootTasks); got != "11\n" {
+		t.Fatalf("root tasks = %q, want \"11\\n\"", got)
+	}
+}
+
+func TestMemFSCgroupDirs(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V1)
+	layout := &Settings.Paths
+	mfs.AddPid(10)
+
+	dir := layout.Cpuset("cs_new")
+	if err := Fs.Mkdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := Fs.Mkdir(dir); !errors.Is(err, syscall.EEXIST) {
+		t.Fatalf("second Mkdir = %v, want EEXIST", err)
+	}
+	for _, file := range []string{CPUSET_CPUS, CPUSET_MEMS, CPUSET_TASKS} {
+		if _, err := Fs.Stat(layout.CpusetFile("cs_new", file)); err != nil {
+			t.Fatalf("control file %s: %v", file, err)
+		}
+	}
+	Fs.WriteFile(layout.CpusetFile("cs_new", CPUSET_CPUS), []byte("0"))
+	Fs.WriteFile(layout.CpusetFile("cs_new", CPUSET_MEMS), []byte("0"))
+	if err := Fs.WriteFile(layout.CpusetFile("cs_new", CPUSET_TASKS), []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Fs.Remove(dir); !errors.Is(err, syscall.EBUSY) {
+		t.Fatalf("Remove of a busy cgroup = %v, want EBUSY", err)
+	}
+	if err := Fs.WriteFile(layout.CpusetFile(CPUSET_DEFAULT, CPUSET_TASKS), []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Fs.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Fs.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat after Remove = %v, want ErrNotExist", err)
+	}
+}
+
+func TestMemFSV2InheritsCpus(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V2)
+	mfs.AddPid(10)
+	threads := CgroupV2{}.threadsFile(filepath.Join(Settings.Paths.resolve(Settings.Paths.Cgroup2Dir), BG_CGROUP))
+	if err := Fs.WriteFile(threads, []byte("10")); err != nil {
+		t.Fatalf("joining a v2 cgroup with empty cpuset.cpus: %v", err)
+	}
+}
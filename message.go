@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+/* Message is one netlink message exchanged with the kernel, in either
+ * direction. On the wire it is an NlMsghdr (host byte order, little-endian
+ * on every device we ship) followed by a body, padded to NLMSG_ALIGNTO:
+ *
+ *   len(u32) type(u16) flags(u16) seq(u32) pid(u32) body
+ *
+ * The body depends on Kind:
+ *
+ *   MESSAGE_COMMAND  a command from the kernel in the Codec layout
+ *                    (see codec.go), e.g. "move_to_cgroup 1234 bg true"
+ *   MESSAGE_REPLY    text from the daemon, as the kernel module parses it:
+ *                    '@' len(u32) text[len]
+ *                    e.g. acks, hello and the legacy mpdecision "0"/"1"
+ *
+ * The body alone does not tell the two apart: a V1 command whose real_len
+ * ends in 0x40 also starts with '@'. The direction does, since the kernel
+ * only sends commands and the daemon only replies, so Unmarshal is told
+ * which kind to expect.
+ */
+type MessageKind int
+
+const (
+	MESSAGE_COMMAND MessageKind = iota
+	MESSAGE_REPLY
+)
+
+const (
+	REPLY_MAGIC    byte = '@'
+	REPLY_HDR_SIZE int  = 1 + 4
+)
+
+type Message struct {
+	Kind  MessageKind
+	Type  uint16
+	Flags uint16
+	Seq   uint32
+	Pid   uint32
+
+	// Cmd is the body of a MESSAGE_COMMAND, Text that of a MESSAGE_REPLY
+	Cmd  NetlinkCmd
+	Text string
+}
+
+func NewReply(text string) *Message {
+	return &Message{Kind: MESSAGE_REPLY, Text: text}
+}
+
+func NewCommand(cmd *NetlinkCmd) *Message {
+	return &Message{Kind: MESSAGE_COMMAND, Seq: cmd.Seq, Cmd: *cmd}
+}
+
+// MpdecisionReply is the echo of the requested state understood by kernels
+// without acks
+func MpdecisionReply(blocked bool) *Message {
+	if blocked {
+		return NewReply("1")
+	}
+	return NewReply("0")
+}
+
+// Marshal encodes m; codec is used for the body of commands
+func (m *Message) Marshal(codec *NetlinkCodec) (b []byte, err error) {
+	var body []byte
+	switch m.Kind {
+	case MESSAGE_COMMAND:
+		if body, err = codec.Encode(&m.Cmd); err != nil {
+			return
+		}
+	case MESSAGE_REPLY:
+		body = make([]byte, REPLY_HDR_SIZE, REPLY_HDR_SIZE+len(m.Text))
+		body[0] = REPLY_MAGIC
+		binary.LittleEndian.PutUint32(body[1:5], uint32(len(m.Text)))
+		body = append(body, m.Text...)
+	default:
+		return nil, fmt.Errorf("Unknown message kind %d", m.Kind)
+	}
+
+	b = make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body)+syscall.NLMSG_ALIGNTO)
+	binary.LittleEndian.PutUint32(b[0:4], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	binary.LittleEndian.PutUint16(b[4:6], m.Type)
+	binary.LittleEndian.PutUint16(b[6:8], m.Flags)
+	binary.LittleEndian.PutUint32(b[8:12], m.Seq)
+	binary.LittleEndian.PutUint32(b[12:16], m.Pid)
+	b = append(b, body...)
+	return nlmsgPad(b), nil
+}
+
+// Unmarshal decodes a message of the given kind received from a socket;
+// codec is used for the body of commands
+func (m *Message) Unmarshal(message syscall.NetlinkMessage, kind MessageKind, codec *NetlinkCodec) (err error) {
+	m.Kind = kind
+	m.Type = message.Header.Type
+	m.Flags = message.Header.Flags
+	m.Seq = message.Header.Seq
+	m.Pid = message.Header.Pid
+
+	body := message.Data
+	switch kind {
+	case MESSAGE_COMMAND:
+		var cmd *NetlinkCmd
+		if cmd, err = codec.Decode(body); err != nil {
+			return
+		}
+		m.Cmd = *cmd
+		m.Cmd.Seq = m.Seq
+	case MESSAGE_REPLY:
+		if len(body) < REPLY_HDR_SIZE {
+			return &CodecError{Err: ErrShortBuffer, Field: "reply", Want: REPLY_HDR_SIZE, Have: len(body)}
+		}
+		if body[0] != REPLY_MAGIC {
+			return fmt.Errorf("Bad reply magic 0x%02x", body[0])
+		}
+		length := binary.LittleEndian.Uint32(body[1:5])
+		if uint64(length) > uint64(len(body)-REPLY_HDR_SIZE) {
+			return &CodecError{Err: ErrLengthOverflow, Field: "reply_len", Offset: 1, Want: int(length), Have: len(body) - REPLY_HDR_SIZE}
+		}
+		m.Text = string(body[REPLY_HDR_SIZE : REPLY_HDR_SIZE+int(length)])
+	default:
+		return fmt.Errorf("Unknown message kind %d", kind)
+	}
+	return
+}
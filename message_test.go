@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+// field pads s with NULs to size bytes
+func field(s string, size int) []byte {
+	b := make([]byte, size)
+	copy(b, s)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// v1Command is a V1 command body as the kernel builds it
+func v1Command(realLen uint32, cmd string, args string) []byte {
+	return concat(le32(realLen),
+		le32(uint32(len(cmd))), field(cmd, NETLINK_CMD_SIZE),
+		le32(uint32(len(args))), field(args, NETLINK_ARGS_SIZE))
+}
+
+func parseOne(t *testing.T, b []byte) syscall.NetlinkMessage {
+	messages, err := syscall.ParseNetlinkMessage(b)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("ParseNetlinkMessage = %d messages, %v", len(messages), err)
+	}
+	return messages[0]
+}
+
+func TestMessageGolden(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec *NetlinkCodec
+		msg   *Message
+		want  []byte
+	}{
+		{
+			name:  "reply",
+			codec: Codec,
+			msg:   &Message{Kind: MESSAGE_REPLY, Seq: 7, Pid: 0x102, Text: "1"},
+			want: []byte{
+				22, 0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0, 2, 1, 0, 0,
+				'@', 1, 0, 0, 0, '1', 0, 0,
+			},
+		},
+		{
+			name:  "v1 command",
+			codec: NewNetlinkCodec(NETLINK_PROTOCOL_V1),
+			msg:   &Message{Kind: MESSAGE_COMMAND, Seq: 3, Cmd: NetlinkCmd{Seq: 3, Cmd: "mpdecision", Args: "1"}},
+			want: concat(
+				[]byte{88, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0},
+				v1Command(68, "mpdecision", "1")),
+		},
+		{
+			name:  "v2 command",
+			codec: NewNetlinkCodec(NETLINK_PROTOCOL_V2),
+			msg:   &Message{Kind: MESSAGE_COMMAND, Seq: 4, Cmd: NetlinkCmd{Seq: 4, Cmd: "mpdecision", Args: "1"}},
+			want: concat(
+				[]byte{43, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0},
+				[]byte{0xff, 0xff, 0xff, 0xff, 2, 0, 0, 0, 10, 0, 0, 0, 1, 0, 0, 0},
+				[]byte("mpdecision1"), []byte{0}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := test.msg.Marshal(test.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, test.want) {
+				t.Fatalf("Marshal =\n%v\nwant\n%v", b, test.want)
+			}
+
+			var m Message
+			if err = m.Unmarshal(parseOne(t, b), test.msg.Kind, test.codec); err != nil {
+				t.Fatal(err)
+			}
+			if m != *test.msg {
+				t.Fatalf("Unmarshal = %+v, want %+v", m, *test.msg)
+			}
+		})
+	}
+}
+
+// A kernel may send a V1 real_len of 64, whose low byte is the reply magic
+func TestMessageCommandRealLen64(t *testing.T) {
+	body := v1Command(64, "move_to_cgroup", "12 bg true")
+	if body[0] != REPLY_MAGIC {
+		t.Fatalf("body starts with 0x%02x, want the reply magic", body[0])
+	}
+	b := concat(le32(uint32(syscall.NLMSG_HDRLEN+len(body))), []byte{0, 0, 0, 0, 9, 0, 0, 0, 0, 0, 0, 0}, body)
+
+	var m Message
+	if err := m.Unmarshal(parseOne(t, b), MESSAGE_COMMAND, Codec); err != nil {
+		t.Fatal(err)
+	}
+	want := NetlinkCmd{Seq: 9, Cmd: "move_to_cgroup", Args: "12 bg true"}
+	if m.Kind != MESSAGE_COMMAND || m.Cmd != want {
+		t.Fatalf("Unmarshal = %+v, want command %+v", m, want)
+	}
+}
+
+func TestMessageUnmarshalReplyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"short", []byte{'@', 1, 0}},
+		{"bad magic", []byte{'#', 1, 0, 0, 0, '1'}},
+		{"length overflow", []byte{'@', 2, 0, 0, 0, '1'}},
+		{"command", v1Command(68, "mpdecision", "1")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := syscall.NetlinkMessage{Data: test.body}
+			var m Message
+			if err := m.Unmarshal(message, MESSAGE_REPLY, Codec); err == nil {
+				t.Fatalf("Unmarshal = %+v, want an error", m)
+			}
+		})
+	}
+}
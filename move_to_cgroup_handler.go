@@ -2,35 +2,12 @@ package main
 
 import (
 	"fmt"
-	"path/filepath"
-	"strconv"
-	"strings"
 )
 
-func MoveToCgroupHandler(cmd *NetlinkCmd) {
-	args := strings.TrimSpace(string(cmd.Args[:]))
-	/* Order is:
-	 * pid(int) cgroup_name(string) should_assign_cpuset(bool)
-	 */
-	tokens := strings.Split(args, " ")
-	if len(tokens) != 3 {
-		log(fmt.Sprintf("Invalid format:  Expected: move_to_cgroup PID(int) cgroup_name(string) should_assign_cpuset(bool)  Got: cgroup %s", args))
-		return
-	}
-
-	pid, err := strconv.Atoi(tokens[0])
-	if err != nil {
-		log(fmt.Sprintf("Failed to convert '%v' to int: %v", tokens[0], err))
-		return
-	}
-
-	cgroup := tokens[1]
-
-	shouldAssignCpuset, err := strconv.ParseBool(tokens[2])
-	if err != nil {
-		log(fmt.Sprintf("Failed to convert '%v' to bool: %v", tokens[2], err))
-		return
-	}
+func MoveToCgroupHandler(sender *NetlinkSender, cmd *NetlinkCmd, args *Args) (err error) {
+	pid := args.Int("pid")
+	cgroup := args.String("cgroup")
+	shouldAssignCpuset := args.Bool("should_assign_cpuset")
 
 	if err = MovePidToCgroup(pid, cgroup); err != nil {
 		log(fmt.Sprintf("Failed to move tid (%v) to '%s' cgroup: %v", pid, cgroup, err))
@@ -42,15 +19,43 @@ func MoveToCgroupHandler(cmd *NetlinkCmd) {
 			return
 		}
 	}
+	return
+}
+
+// MoveTasksHandler moves a batch of pids. Every pid is attempted; the
+// first failure decides the errno reported to the kernel.
+func MoveTasksHandler(sender *NetlinkSender, cmd *NetlinkCmd, args *Args) (err error) {
+	cgroup := args.String("cgroup")
+	shouldAssignCpuset := args.Bool("should_assign_cpuset")
+	pids := args.IntList("pids")
+
+	var firstErr error
+	var firstPid int
+	failed := 0
+	for _, pid := range pids {
+		if err = MovePidToCgroup(pid, cgroup); err == nil && shouldAssignCpuset {
+			err = MovePidToCpuset(pid, cgroup)
+		}
+		if err != nil {
+			log(fmt.Sprintf("Failed to move tid (%v) to '%s': %v", pid, cgroup, err))
+			if firstErr == nil {
+				firstErr = err
+				firstPid = pid
+			}
+			failed++
+		}
+	}
+	log(fmt.Sprintf("Moved %d/%d tids to '%s'", len(pids)-failed, len(pids), cgroup))
+	if firstErr != nil {
+		return &CommandError{Errno: ErrnoOf(firstErr), Reason: fmt.Sprintf("%d/%d failed, pid %d: %v", failed, len(pids), firstPid, firstErr)}
+	}
+	return nil
 }
 
 func MovePidToCgroup(pid int, cgroup string) error {
-	cgroupTasksPath := fmt.Sprintf("/dev/cpuctl/%s/tasks", cgroup)
-	return write(cgroupTasksPath, pid)
+	return write(Cgroups.CgroupTasks(cgroup), pid)
 }
 
 func MovePidToCpuset(pid int, cgroup string) error {
-	cpuset := fmt.Sprintf("cs_%s", cgroup)
-	cpusetTasksPath := filepath.Join(CpusetBasePath, cpuset, "tasks")
-	return write(cpusetTasksPath, pid)
+	return write(Cgroups.CpusetTasks(CgroupCpuset(cgroup)), pid)
 }
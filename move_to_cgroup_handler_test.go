@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestMovePidToCpuset(t *testing.T) {
+	for _, version := range []string{CGROUP_V1, CGROUP_V2} {
+		t.Run(version, func(t *testing.T) {
+			mfs := useMemFS(t, version)
+			mfs.AddPid(10)
+			bg := CgroupCpuset(BG_CGROUP)
+
+			// The bg cpuset has no cpus yet: v1 refuses tasks, v2 inherits
+			err := MovePidToCpuset(10, BG_CGROUP)
+			if version == CGROUP_V1 && !errors.Is(err, syscall.EINVAL) {
+				t.Fatalf("move to an empty cpuset = %v, want EINVAL", err)
+			}
+			if version == CGROUP_V2 && err != nil {
+				t.Fatalf("move to an inheriting cpuset = %v", err)
+			}
+
+			Fs.WriteFile(Cgroups.CpusetFile(bg, CPUSET_MEMS), []byte("0"))
+			Fs.WriteFile(Cgroups.CpusetFile(bg, CPUSET_CPUS), []byte("0"))
+			if err = MovePidToCpuset(99, BG_CGROUP); !errors.Is(err, syscall.ESRCH) {
+				t.Fatalf("move of an unknown pid = %v, want ESRCH", err)
+			}
+			if err = MovePidToCpuset(10, BG_CGROUP); err != nil {
+				t.Fatal(err)
+			}
+			if tids, err := Cpusets.Tasks(bg); err != nil || len(tids) != 1 || tids[0] != 10 {
+				t.Fatalf("bg tasks = %v, %v, want [10]", tids, err)
+			}
+		})
+	}
+}
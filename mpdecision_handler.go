@@ -2,33 +2,32 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-func MpdecisionHandler(cmd *NetlinkCmd) {
-	args := strings.TrimSpace(string(cmd.Args[:]))
-	signal := make(chan struct{}, 0)
-	switch args {
-	case "0":
-		// Kernel is disabling mpdecision blocking
-		log("Kernel disabling mpdecision blocking")
-		go UnblockMpdecision(signal)
-		<-signal
-		Socket.SendString("0")
-	case "1":
+func MpdecisionHandler(sender *NetlinkSender, cmd *NetlinkCmd, args *Args) (err error) {
+	block := args.Bool("block")
+	if block {
 		// Kernel is enabling mpdecision blocking
 		log("Kernel enabling mpdecision blocking")
-		go BlockMpdecision(signal)
-		<-signal
-		Socket.SendString("1")
-	default:
-		log(fmt.Sprintf("Unknown message from kernel: '%s'", args))
+		err = Mpdecision.Block()
+	} else {
+		// Kernel is disabling mpdecision blocking
+		log("Kernel disabling mpdecision blocking")
+		err = Mpdecision.Unblock()
 	}
+	if !PeerCaps.Supports(ACK_FEATURE) {
+		// Older kernels only understand an echo of the state. Report the
+		// state we ended up in, which is not the requested one if the
+		// transition failed and was rolled back.
+		state, _ := Mpdecision.State()
+		sender.Send(MpdecisionReply(state == MPDECISION_BLOCKED))
+	}
+	return
 }
 
 func MpdecisionCoexistUpcallHandler(container *InotifyContainer) {
@@ -36,28 +35,38 @@ func MpdecisionCoexistUpcallHandler(container *InotifyContainer) {
 
 	handleUpcall := func() {
 		var err error
-		file := "/sys/fs/cgroup/cpuset/cs_bg_non_interactive/cpuset.cpus"
-		rootCpusetCpus := "/sys/fs/cgroup/cpuset/cpuset.cpus"
+		file := Cgroups.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_CPUS)
+		rootCpusetCpus := Cgroups.CpusetFile(CPUSET_DEFAULT, CPUSET_CPUS)
 
 		log("Handling mpdecision upcall")
 
+		var bgCpus CpuList
+		var topology *Topology
+		if bgCpus, err = readBgCpus(); err != nil {
+			log("Failed to read background cpus:", err)
+			return
+		}
+
 		switch mpdecisionBlocked {
 		case 1:
-			cpus := "0"
-			if err = write(file, cpus); err != nil {
-				log(fmt.Sprintf("Failed to write '%s' to: %s", cpus, file))
+			if err = write(file, bgCpus); err != nil {
+				log(fmt.Sprintf("Failed to write '%s' to: %s", bgCpus, file))
 				break
 			}
 		case 0:
-			cpus := "0-3"
+			if topology, err = DiscoverTopology(); err != nil {
+				log("Failed to discover cpu topology:", err)
+				break
+			}
 			// First write this to the root cpuset
+			cpus := topology.AllOnline()
 			if err = write(rootCpusetCpus, cpus); err != nil {
 				log(fmt.Sprintf("Failed to write '%s' to: %s", cpus, rootCpusetCpus))
 				break
 			}
 
-			if err = write(file, "0"); err != nil {
-				log(fmt.Sprintf("Failed to write '%s' to: %s", cpus, file))
+			if err = write(file, bgCpus); err != nil {
+				log(fmt.Sprintf("Failed to write '%s' to: %s", bgCpus, file))
 				break
 			}
 		default:
@@ -68,9 +77,9 @@ func MpdecisionCoexistUpcallHandler(container *InotifyContainer) {
 	work := func() error {
 		var err error
 
-		filePath := "/sys/tempfreq/mpdecision_coexist_upcall"
+		filePath := Settings.Paths.Tempfreq("mpdecision_coexist_upcall")
 		var bytes []byte
-		if bytes, err = ioutil.ReadFile(filePath); err != nil {
+		if bytes, err = Fs.ReadFile(filePath); err != nil {
 			log("Failed to read file:", filePath)
 			return err
 		} else {
@@ -95,54 +104,93 @@ func MpdecisionCoexistUpcallHandler(container *InotifyContainer) {
 	container.NotifyChannel <- struct{}{}
 }
 
-func BlockMpdecision(signal chan struct{}) {
+// readBgCpus reads the cpus the kernel wants background tasks confined to
+// and rejects lists that are malformed, empty or name offline cpus
+func readBgCpus() (cpus CpuList, err error) {
 	var b []byte
-	var err error
-	var bgCpus string
+	bgCpuFile := Settings.Paths.Tempfreq("mpdecision_bg_cpu")
+	if b, err = Fs.ReadFile(bgCpuFile); err != nil {
+		return
+	}
+	if cpus, err = ParseValidCpuList(string(b)); err != nil {
+		return
+	}
+	if cpus.IsEmpty() {
+		err = CommandErrorf(syscall.EINVAL, "no background cpu in %s", bgCpuFile)
+	}
+	return
+}
+
+// blockMpdecision confines background tasks to the bg cpus. It is the
+// blocking transition of Mpdecision; on failure every change is rolled
+// back.
+func blockMpdecision() (err error) {
+	var bgCpus, fgBgCpus CpuList
+	var topology *Topology
+	tx := NewTransaction("mpdecision block")
 	//bgNotifyContainer := new(InotifyContainer)
 
-	bgCpuFile := "/sys/tempfreq/mpdecision_bg_cpu"
-	bgCpusetCpusFile := "/sys/fs/cgroup/cpuset/cs_bg_non_interactive/cpuset.cpus"
-	bgCpusetMemsFile := "/sys/fs/cgroup/cpuset/cs_bg_non_interactive/cpuset.mems"
-	bgCpusetTasksFile := "/sys/fs/cgroup/cpuset/cs_bg_non_interactive/tasks"
-	bgCgroupTasksFile := "/dev/cpuctl/bg_non_interactive/tasks"
+	bgCpuset := CgroupCpuset(BG_CGROUP)
+	fgBgCpuset := CgroupCpuset(FG_BG_CGROUP)
 
-	fgBgCgroupTasksFile := "/dev/cpuctl/fg_bg/tasks"
-	fgBgCpusetTasksFile := "/sys/fs/cgroup/cpuset/cs_fg_bg/tasks"
+	bgCpusetCpusFile := Cgroups.CpusetFile(bgCpuset, CPUSET_CPUS)
+	bgCpusetMemsFile := Cgroups.CpusetFile(bgCpuset, CPUSET_MEMS)
+	bgCpusetTasksFile := Cgroups.CpusetTasks(bgCpuset)
+	bgCgroupTasksFile := Cgroups.CgroupTasks(BG_CGROUP)
 
-	fgBgCpusetCpusFile := "/sys/fs/cgroup/cpuset/cs_fg_bg/cpuset.cpus"
-	fgBgCpusetMemsFile := "/sys/fs/cgroup/cpuset/cs_fg_bg/cpuset.mems"
+	fgBgCgroupTasksFile := Cgroups.CgroupTasks(FG_BG_CGROUP)
+	fgBgCpusetTasksFile := Cgroups.CpusetTasks(fgBgCpuset)
 
-	if isBlocked {
-		log("Attempting to block mpdecision when blocked")
-		err = fmt.Errorf("Already blocked")
-		goto out
-	}
+	fgBgCpusetCpusFile := Cgroups.CpusetFile(fgBgCpuset, CPUSET_CPUS)
+	fgBgCpusetMemsFile := Cgroups.CpusetFile(fgBgCpuset, CPUSET_MEMS)
 
-	isBlocked = true
+	// With cgroup v2 the bg cpuset is the bg cgroup itself: its tasks are
+	// already members and mems is inherited, so only cpus change
+	separate := Cgroups.SeparateCpusets()
 
-	if b, err = ioutil.ReadFile(bgCpuFile); err != nil {
-		log(fmt.Sprintf("Failed to read '%s': %s", bgCpuFile, err))
-		return
+	// Validate everything before the first cgroup write
+	if bgCpus, err = readBgCpus(); err != nil {
+		log("Failed to read background cpus:", err)
+		goto out
 	}
-	bgCpus = string(b[:])
-
-	if err = write(bgCpusetMemsFile, "0"); err != nil {
-		log("Failed to set mems to '0':", err)
+	if topology, err = DiscoverTopology(); err != nil {
+		log("Failed to discover cpu topology:", err)
 		goto out
 	}
-	if err = write(bgCpusetCpusFile, bgCpus); err != nil {
+	// fg_bg tasks keep off the bg cpus, unless those are all there is
+	fgBgCpus = topology.AllOnline().Difference(bgCpus)
+	if fgBgCpus.IsEmpty() {
+		fgBgCpus = topology.AllOnline()
+	}
+
+	if separate {
+		if err = tx.Write(bgCpusetMemsFile, "0"); err != nil {
+			log("Failed to set mems to '0':", err)
+			goto out
+		}
+	}
+	if err = tx.Write(bgCpusetCpusFile, bgCpus); err != nil {
 		log(fmt.Sprintf("Failed to set cpus to '%s':%v", bgCpus, err))
 		goto out
 	}
 
-	if err = migrateTasks(bgCgroupTasksFile, bgCpusetTasksFile); err != nil {
-		log("Failed to migrate tasks from bg cgroup to bg cpuset")
-		goto out
+	if separate {
+		if err = tx.MigrateTasks(bgCgroupTasksFile, bgCpusetTasksFile); err != nil {
+			log("Failed to migrate tasks from bg cgroup to bg cpuset:", err)
+			goto out
+		}
 	}
 
-	write(fgBgCpusetCpusFile, "0-3")
-	write(fgBgCpusetMemsFile, "0")
+	if err = tx.Write(fgBgCpusetCpusFile, fgBgCpus); err != nil {
+		log(fmt.Sprintf("Failed to set fg_bg cpus to '%s':%v", fgBgCpus, err))
+		goto out
+	}
+	if separate {
+		if err = tx.Write(fgBgCpusetMemsFile, "0"); err != nil {
+			log("Failed to set fg_bg mems to '0':", err)
+			goto out
+		}
+	}
 
 	_ = fgBgCgroupTasksFile
 	_ = fgBgCpusetTasksFile
@@ -156,54 +204,56 @@ func BlockMpdecision(signal chan struct{}) {
 	// We don't add a watcher since the kernel takes care of doing this
 	// once we send it the signal that we've set up the cpuset
 	/*
-		bgNotifyContainer.FilePath = "/dev/cpuctl/bg_non_interactive/tasks"
+		bgNotifyContainer.FilePath = Cgroups.CgroupTasks(BG_CGROUP)
 		bgNotifyContainer.NotifyChannel = make(chan struct{}, 0)
 		bgNotifyContainer.Handler = BgCgroupHandler
 		AddWatcher(bgNotifyContainer)
 	*/
 out:
-	// Signal that we're done
-	signal <- struct{}{}
-
-	if err == nil {
-		// Now wait for unblock to signal us to terminate
-		<-signalChan
-		log("Received signal to unblock")
-	}
 	//bgNotifyContainer.IsDone = true
+	if err != nil {
+		return tx.Abort(err)
+	}
+	tx.Commit()
+	return
 }
 
-func UnblockMpdecision(signal chan struct{}) {
-	var err error
+// unblockMpdecision releases background tasks back to the root cpuset. It
+// is the unblocking transition of Mpdecision; on failure every change is
+// rolled back.
+func unblockMpdecision() (err error) {
+	tx := NewTransaction("mpdecision unblock")
+	bgCpuset := CgroupCpuset(BG_CGROUP)
 
-	rootCpusetTasksFile := "/sys/fs/cgroup/cpuset/tasks"
-	bgCpusetTasksFile := "/sys/fs/cgroup/cpuset/cs_bg_non_interactive/tasks"
-	bgCpusetCpusFile := "/sys/fs/cgroup/cpuset/cs_bg_non_interactive/cpuset.cpus"
-	bgCpusetMemsFile := "/sys/fs/cgroup/cpuset/cs_bg_non_interactive/cpuset.mems"
-	fgBgCpusetTasksFile := "/sys/fs/cgroup/cpuset/cs_fg_bg/tasks"
+	rootCpusetTasksFile := Cgroups.CpusetTasks(CPUSET_DEFAULT)
+	bgCpusetTasksFile := Cgroups.CpusetTasks(bgCpuset)
+	bgCpusetCpusFile := Cgroups.CpusetFile(bgCpuset, CPUSET_CPUS)
+	bgCpusetMemsFile := Cgroups.CpusetFile(bgCpuset, CPUSET_MEMS)
+	fgBgCpusetTasksFile := Cgroups.CpusetTasks(CgroupCpuset(FG_BG_CGROUP))
 
-	if !isBlocked {
-		log("Attempting to unblock mpdecision when not blocked")
-		goto out
-	}
-	// Signal block to terminate
-	signalChan <- struct{}{}
-	log("Sent signal to unblock")
-	isBlocked = false
-	if err = write(bgCpusetMemsFile, ""); err != nil {
-		log("Unblock: Failed to set mems to '':", err)
-		goto out
+	// With cgroup v2 leaving the bg cpuset would mean leaving the bg
+	// cgroup; an empty cpuset.cpus lets it inherit every cpu instead
+	separate := Cgroups.SeparateCpusets()
+
+	// Drain the cpuset before clearing it: the kernel will not empty the
+	// cpus of a cpuset with tasks, and a rollback has to refill it in the
+	// opposite order
+	if separate {
+		if err = tx.MigrateTasks(bgCpusetTasksFile, rootCpusetTasksFile); err != nil {
+			log(fmt.Sprintf("Unblock: Failed to migrate tasks from bg_non_interactive to root:%v", err))
+			goto out
+		}
+
+		if err = tx.Write(bgCpusetMemsFile, ""); err != nil {
+			log("Unblock: Failed to set mems to '':", err)
+			goto out
+		}
 	}
-	if err = write(bgCpusetCpusFile, ""); err != nil {
+	if err = tx.Write(bgCpusetCpusFile, ""); err != nil {
 		log(fmt.Sprintf("Unblock: Failed to set cpus to '':%v", err))
 		goto out
 	}
 
-	if err = migrateTasks(bgCpusetTasksFile, rootCpusetTasksFile); err != nil {
-		log(fmt.Sprintf("Unblock: Failed to migrate tasks from bg_non_interactive to root:%v", err))
-		goto out
-	}
-
 	_ = fgBgCpusetTasksFile
 	/*
 		if err = migrateTasks(fgBgCpusetTasksFile, rootCpusetTasksFile); err != nil {
@@ -212,6 +262,9 @@ func UnblockMpdecision(signal chan struct{}) {
 		}
 	*/
 out:
-	// Signal that we're done
-	signal <- struct{}{}
+	if err != nil {
+		return tx.Abort(err)
+	}
+	tx.Commit()
+	return
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlockMpdecisionFgBgCpus(t *testing.T) {
+	tests := []struct {
+		bgCpus string
+		want   string
+	}{
+		{"0", "1-3"},
+		{"0-1", "2-3"},
+		// fg_bg may not be left empty
+		{"0-3", "0-3"},
+	}
+	for _, test := range tests {
+		t.Run(test.bgCpus, func(t *testing.T) {
+			// useMemFS also sets Cgroups and restores both on cleanup
+			useMemFS(t, CGROUP_V1)
+			Fs.WriteFile(Settings.Paths.Tempfreq("mpdecision_bg_cpu"), []byte(test.bgCpus))
+			if err := blockMpdecision(); err != nil {
+				t.Fatal(err)
+			}
+			fgBgCpus := Cgroups.CpusetFile(CgroupCpuset(FG_BG_CGROUP), CPUSET_CPUS)
+			if got := strings.TrimSpace(readString(t, fgBgCpus)); got != test.want {
+				t.Errorf("fg_bg cpus = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBlockUnblockMpdecision(t *testing.T) {
+	for _, version := range []string{CGROUP_V1, CGROUP_V2} {
+		t.Run(version, func(t *testing.T) {
+			mfs := useMemFS(t, version)
+			bg := CgroupCpuset(BG_CGROUP)
+			// 10 and 11 are background tasks, 12 is not
+			for _, pid := range []int{10, 11, 12} {
+				mfs.AddPid(pid)
+			}
+			for _, pid := range []string{"10", "11"} {
+				if err := Fs.WriteFile(Cgroups.CgroupTasks(BG_CGROUP), []byte(pid)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			files := []string{
+				Cgroups.CpusetFile(bg, CPUSET_CPUS),
+				Cgroups.CpusetFile(bg, CPUSET_MEMS),
+				Cgroups.CpusetTasks(bg),
+				Cgroups.CpusetTasks(CPUSET_DEFAULT),
+			}
+			before := make(map[string]string)
+			for _, file := range files {
+				before[file] = readString(t, file)
+			}
+
+			if err := blockMpdecision(); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(readString(t, files[0])); got != "0" {
+				t.Fatalf("blocked bg cpus = %q, want 0", got)
+			}
+			if got := strings.Fields(readString(t, files[2])); len(got) != 2 || got[0] != "10" || got[1] != "11" {
+				t.Fatalf("blocked bg tasks = %v, want [10 11]", got)
+			}
+
+			if err := unblockMpdecision(); err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range files {
+				if got := readString(t, file); got != before[file] {
+					t.Errorf("%s = %q after unblock, want %q", file, got, before[file])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type MpdecisionState int
+
+const (
+	MPDECISION_UNBLOCKED MpdecisionState = iota
+	MPDECISION_BLOCKING
+	MPDECISION_BLOCKED
+	MPDECISION_UNBLOCKING
+	// The last transition failed half way; cgroups are in an unknown state
+	// until a block or unblock succeeds
+	MPDECISION_FAILED
+)
+
+const MPDECISION_TIMEOUT = 5 * time.Second
+
+func (s MpdecisionState) String() string {
+	switch s {
+	case MPDECISION_UNBLOCKED:
+		return "unblocked"
+	case MPDECISION_BLOCKING:
+		return "blocking"
+	case MPDECISION_BLOCKED:
+		return "blocked"
+	case MPDECISION_UNBLOCKING:
+		return "unblocking"
+	case MPDECISION_FAILED:
+		return "failed"
+	default:
+		return fmt.Sprintf("MpdecisionState(%d)", int(s))
+	}
+}
+
+/* MpdecisionFSM serializes mpdecision block and unblock requests:
+ *
+ *   unblocked --block--> blocking --ok--> blocked
+ *   blocked --unblock--> unblocking --ok--> unblocked
+ *   blocking, unblocking --error, rolled back--> the state it started from
+ *   blocking, unblocking --error--> failed
+ *   failed --block--> blocking, failed --unblock--> unblocking
+ *
+ * Requests are idempotent: asking for the current state succeeds without
+ * touching cgroups. A request arriving during a transition waits for it to
+ * finish; if the transition was heading to the requested state its outcome
+ * is shared, otherwise the request starts the reverse transition.
+ *
+ * The cgroup work runs in its own goroutine. A request waits for at most
+ * Timeout and then fails with ETIMEDOUT; the transition still completes in
+ * the background and later requests observe its outcome.
+ */
+type MpdecisionFSM struct {
+	Timeout time.Duration
+	mutex   sync.Mutex
+	state   MpdecisionState
+	lastErr error
+	// current is the transition in progress, nil in a stable state
+	current *mpdecisionTransition
+	// changed is closed and replaced on every state change
+	changed chan struct{}
+	block   func() error
+	unblock func() error
+}
+
+type mpdecisionTransition struct {
+	from   MpdecisionState
+	target MpdecisionState
+	err    error
+	done   chan struct{}
+}
+
+var Mpdecision = NewMpdecisionFSM(blockMpdecision, unblockMpdecision)
+
+func NewMpdecisionFSM(block func() error, unblock func() error) *MpdecisionFSM {
+	return &MpdecisionFSM{
+		Timeout: MPDECISION_TIMEOUT,
+		state:   MPDECISION_UNBLOCKED,
+		changed: make(chan struct{}),
+		block:   block,
+		unblock: unblock,
+	}
+}
+
+// State returns the current state and the error of the last transition if
+// it failed
+func (fsm *MpdecisionFSM) State() (MpdecisionState, error) {
+	fsm.mutex.Lock()
+	defer fsm.mutex.Unlock()
+	return fsm.state, fsm.lastErr
+}
+
+// Changed returns a channel that is closed on the next state change
+func (fsm *MpdecisionFSM) Changed() <-chan struct{} {
+	fsm.mutex.Lock()
+	defer fsm.mutex.Unlock()
+	return fsm.changed
+}
+
+// setState must be called with the mutex held
+func (fsm *MpdecisionFSM) setState(state MpdecisionState, err error) {
+	log(fmt.Sprintf("mpdecision: %v -> %v", fsm.state, state))
+	fsm.state = state
+	fsm.lastErr = err
+	close(fsm.changed)
+	fsm.changed = make(chan struct{})
+}
+
+func (fsm *MpdecisionFSM) run(t *mpdecisionTransition, work func() error) {
+	err := work()
+	fsm.mutex.Lock()
+	defer fsm.mutex.Unlock()
+	t.err = err
+	fsm.current = nil
+	var txErr *TransactionError
+	if errors.As(err, &txErr) && txErr.RolledBack() {
+		fsm.setState(t.from, err)
+	} else if err != nil {
+		fsm.setState(MPDECISION_FAILED, err)
+	} else {
+		fsm.setState(t.target, nil)
+	}
+	close(t.done)
+}
+
+// Block moves to MPDECISION_BLOCKED
+func (fsm *MpdecisionFSM) Block() error {
+	return fsm.Request(true)
+}
+
+// Unblock moves to MPDECISION_UNBLOCKED
+func (fsm *MpdecisionFSM) Unblock() error {
+	return fsm.Request(false)
+}
+
+func (fsm *MpdecisionFSM) Request(block bool) (err error) {
+	target, via, work := MPDECISION_UNBLOCKED, MPDECISION_UNBLOCKING, fsm.unblock
+	if block {
+		target, via, work = MPDECISION_BLOCKED, MPDECISION_BLOCKING, fsm.block
+	}
+	timer := time.NewTimer(fsm.Timeout)
+	defer timer.Stop()
+
+	fsm.mutex.Lock()
+	defer fsm.mutex.Unlock()
+	for {
+		if fsm.current == nil {
+			if fsm.state == target {
+				return nil
+			}
+			fsm.current = &mpdecisionTransition{from: fsm.state, target: target, done: make(chan struct{})}
+			fsm.setState(via, nil)
+			go fsm.run(fsm.current, work)
+		}
+		t := fsm.current
+		fsm.mutex.Unlock()
+		select {
+		case <-t.done:
+			fsm.mutex.Lock()
+		case <-timer.C:
+			fsm.mutex.Lock()
+			return CommandErrorf(syscall.ETIMEDOUT, "mpdecision still %v after %v", fsm.state, fsm.Timeout)
+		}
+		if t.target == target {
+			return t.err
+		}
+		// The reverse transition finished; start ours
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// mpdecisionStub stands in for blockMpdecision or unblockMpdecision. It
+// records the state the FSM was in while it ran and can be held with gate.
+type mpdecisionStub struct {
+	fsm   *MpdecisionFSM
+	calls int32
+	gate  chan struct{}
+	err   error
+	seen  MpdecisionState
+}
+
+func (stub *mpdecisionStub) run() error {
+	atomic.AddInt32(&stub.calls, 1)
+	stub.seen, _ = stub.fsm.State()
+	if stub.gate != nil {
+		<-stub.gate
+	}
+	return stub.err
+}
+
+func (stub *mpdecisionStub) Calls() int {
+	return int(atomic.LoadInt32(&stub.calls))
+}
+
+func newStubFSM() (fsm *MpdecisionFSM, block *mpdecisionStub, unblock *mpdecisionStub) {
+	block, unblock = new(mpdecisionStub), new(mpdecisionStub)
+	fsm = NewMpdecisionFSM(block.run, unblock.run)
+	block.fsm, unblock.fsm = fsm, fsm
+	return
+}
+
+// moveTo drives fsm from unblocked to state through successful requests
+// and a failed block for MPDECISION_FAILED
+func moveTo(t *testing.T, fsm *MpdecisionFSM, block *mpdecisionStub, state MpdecisionState) {
+	switch state {
+	case MPDECISION_UNBLOCKED:
+	case MPDECISION_BLOCKED:
+		if err := fsm.Block(); err != nil {
+			t.Fatal(err)
+		}
+	case MPDECISION_FAILED:
+		block.err = syscall.EIO
+		fsm.Block()
+		block.err = nil
+	default:
+		t.Fatalf("cannot move to %v", state)
+	}
+	if got, _ := fsm.State(); got != state {
+		t.Fatalf("setup: state = %v, want %v", got, state)
+	}
+}
+
+var (
+	errRolledBack = &TransactionError{Name: "stub", Err: syscall.EIO}
+	errHalfDone   = &TransactionError{Name: "stub", Err: syscall.EIO, RollbackErr: syscall.EBUSY}
+)
+
+// Every arrow of the diagram on MpdecisionFSM
+func TestMpdecisionTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  MpdecisionState
+		block bool
+		err   error
+		via   MpdecisionState
+		want  MpdecisionState
+	}{
+		{"block", MPDECISION_UNBLOCKED, true, nil, MPDECISION_BLOCKING, MPDECISION_BLOCKED},
+		{"unblock", MPDECISION_BLOCKED, false, nil, MPDECISION_UNBLOCKING, MPDECISION_UNBLOCKED},
+		{"block rolled back", MPDECISION_UNBLOCKED, true, errRolledBack, MPDECISION_BLOCKING, MPDECISION_UNBLOCKED},
+		{"unblock rolled back", MPDECISION_BLOCKED, false, errRolledBack, MPDECISION_UNBLOCKING, MPDECISION_BLOCKED},
+		{"block failed", MPDECISION_UNBLOCKED, true, syscall.EIO, MPDECISION_BLOCKING, MPDECISION_FAILED},
+		{"block rollback failed", MPDECISION_UNBLOCKED, true, errHalfDone, MPDECISION_BLOCKING, MPDECISION_FAILED},
+		{"unblock failed", MPDECISION_BLOCKED, false, syscall.EIO, MPDECISION_UNBLOCKING, MPDECISION_FAILED},
+		{"block from failed", MPDECISION_FAILED, true, nil, MPDECISION_BLOCKING, MPDECISION_BLOCKED},
+		{"unblock from failed", MPDECISION_FAILED, false, nil, MPDECISION_UNBLOCKING, MPDECISION_UNBLOCKED},
+		{"block rolled back from failed", MPDECISION_FAILED, true, errRolledBack, MPDECISION_BLOCKING, MPDECISION_FAILED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsm, block, unblock := newStubFSM()
+			moveTo(t, fsm, block, test.from)
+			stub := unblock
+			if test.block {
+				stub = block
+			}
+			calls := stub.Calls()
+			stub.err = test.err
+
+			if err := fsm.Request(test.block); !errors.Is(err, test.err) {
+				t.Fatalf("Request(%v) = %v, want %v", test.block, err, test.err)
+			}
+			if stub.Calls() != calls+1 {
+				t.Fatalf("work ran %d times, want once", stub.Calls()-calls)
+			}
+			if stub.seen != test.via {
+				t.Fatalf("state during work = %v, want %v", stub.seen, test.via)
+			}
+			state, lastErr := fsm.State()
+			if state != test.want {
+				t.Fatalf("state = %v, want %v", state, test.want)
+			}
+			if !errors.Is(lastErr, test.err) {
+				t.Fatalf("last error = %v, want %v", lastErr, test.err)
+			}
+		})
+	}
+}
+
+func TestMpdecisionIdempotent(t *testing.T) {
+	fsm, block, unblock := newStubFSM()
+	if err := fsm.Unblock(); err != nil || unblock.Calls() != 0 {
+		t.Fatalf("Unblock while unblocked = %v after %d calls", err, unblock.Calls())
+	}
+	for i := 0; i < 3; i++ {
+		if err := fsm.Block(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if block.Calls() != 1 {
+		t.Fatalf("block ran %d times, want once", block.Calls())
+	}
+	for i := 0; i < 3; i++ {
+		if err := fsm.Unblock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if unblock.Calls() != 1 {
+		t.Fatalf("unblock ran %d times, want once", unblock.Calls())
+	}
+}
+
+func TestMpdecisionTimeout(t *testing.T) {
+	fsm, block, _ := newStubFSM()
+	fsm.Timeout = 20 * time.Millisecond
+	block.gate = make(chan struct{})
+
+	if err := fsm.Block(); !errors.Is(err, syscall.ETIMEDOUT) {
+		t.Fatalf("Block = %v, want ETIMEDOUT", err)
+	}
+	// The transition keeps running after the request gave up
+	if state, _ := fsm.State(); state != MPDECISION_BLOCKING {
+		t.Fatalf("state after timeout = %v, want %v", state, MPDECISION_BLOCKING)
+	}
+	changed := fsm.Changed()
+	close(block.gate)
+	<-changed
+	if state, _ := fsm.State(); state != MPDECISION_BLOCKED {
+		t.Fatalf("state = %v, want %v", state, MPDECISION_BLOCKED)
+	}
+	if err := fsm.Block(); err != nil || block.Calls() != 1 {
+		t.Fatalf("Block after the transition = %v after %d calls", err, block.Calls())
+	}
+}
+
+// Requests joining a transition heading their way share its outcome; one
+// heading the other way waits for it and then reverses it
+func TestMpdecisionJoin(t *testing.T) {
+	fsm, block, unblock := newStubFSM()
+	block.gate = make(chan struct{})
+	block.err = syscall.EIO
+	changed := fsm.Changed()
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- fsm.Block() }()
+	}
+	<-changed
+	done := make(chan error)
+	go func() { done <- fsm.Unblock() }()
+	close(block.gate)
+
+	for i := 0; i < 3; i++ {
+		if err := <-errs; !errors.Is(err, syscall.EIO) {
+			t.Fatalf("Block = %v, want EIO", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Unblock = %v", err)
+	}
+	if block.Calls() != 1 || unblock.Calls() != 1 {
+		t.Fatalf("block ran %d and unblock %d times, want once each", block.Calls(), unblock.Calls())
+	}
+	if state, _ := fsm.State(); state != MPDECISION_UNBLOCKED {
+		t.Fatalf("state = %v, want %v", state, MPDECISION_UNBLOCKED)
+	}
+}
+
+// Run with -race
+func TestMpdecisionConcurrent(t *testing.T) {
+	fsm, block, unblock := newStubFSM()
+	var running int32
+	guard := func(stub *mpdecisionStub) func() error {
+		return func() error {
+			if atomic.AddInt32(&running, 1) != 1 {
+				t.Error("block and unblock ran at the same time")
+			}
+			defer atomic.AddInt32(&running, -1)
+			time.Sleep(time.Millisecond)
+			return stub.run()
+		}
+	}
+	fsm.block, fsm.unblock = guard(block), guard(unblock)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fsm.Request(i%2 == 0); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := fsm.State()
+	if err != nil || (state != MPDECISION_BLOCKED && state != MPDECISION_UNBLOCKED) {
+		t.Fatalf("state = %v, %v; want a stable state", state, err)
+	}
+	if block.Calls() == 0 {
+		t.Fatal("block never ran")
+	}
+	// Every unblock follows a block
+	if diff := block.Calls() - unblock.Calls(); diff < 0 || diff > 1 {
+		t.Fatalf("block ran %d and unblock %d times", block.Calls(), unblock.Calls())
+	}
+}
@@ -1,37 +1,34 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"syscall"
+	"time"
 )
 
 const (
 	MPDECISION_COEXIST int = syscall.NETLINK_USERSOCK
 	NETLINK_CMD_SIZE   int = 24
 	NETLINK_ARGS_SIZE  int = 36
-)
 
-var (
-	Socket *NetlinkSocket
-	SeqNum uint32 = 0
+	// Not exported by package syscall
+	SOL_NETLINK int = 270
 )
 
+// SocketInterface is the transport between the daemon and the kernel. All
+// implementations exchange netlink-framed messages so that handlers do not
+// care whether they are talking to a real kernel or a simulated peer.
+// Implementations need not be safe for concurrent sends; NetlinkSender
+// serializes them.
 type SocketInterface interface {
-	SendString(message string) error
-	Send(b []byte) error
-	Recv() ([]syscall.NetlinkMessage, error)
-}
-
-type NetlinkPacket struct {
-	NlMsgHdr syscall.NlMsghdr
-	Magic    string
-	Length   uint32
-	Data     *[]byte
+	Send(m *Message) error
+	Recv() ([]syscall.NetlinkMessage, *Peer, error)
+	Close() error
 }
 
 type NetlinkCmd struct {
+	Seq  uint32
 	Cmd  string
 	Args string
 }
@@ -40,117 +37,178 @@ func (cmd *NetlinkCmd) String() string {
 	return fmt.Sprintf("%v:%v", cmd.Cmd, cmd.Args)
 }
 
-func NewNetlinkPacket() (pkt *NetlinkPacket) {
-	pkt = new(NetlinkPacket)
-	pkt.Magic = "@"
-	return
+type NetlinkSocket struct {
+	Fd     int
+	Addr   syscall.SockaddrNetlink
+	Config NetlinkConfig
 }
 
-func (n *NetlinkPacket) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, n.NlMsgHdr)
-	log("After header:", buf.Len())
-
-	buf.Write([]byte(n.Magic))
-	log("After magic:", buf.Len())
-
-	rlBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(rlBytes, n.Length)
-	buf.Write(rlBytes)
-	log("After len:", buf.Len())
-
-	buf.Write(*n.Data)
-	log("After data:", buf.Len())
+func (nl *NetlinkSocket) Send(m *Message) error {
+	var destAddr syscall.SockaddrNetlink
 
-	return buf.Bytes()
+	destAddr.Family = syscall.AF_NETLINK
+	destAddr.Pid = nl.Config.DestPort
+	destAddr.Groups = nl.Config.DestGroup
+
+	msg := *m
+	msg.Pid = nl.Addr.Pid
+	pktBytes, err := msg.Marshal(Codec)
+	if err != nil {
+		return err
+	}
+	Capture.Outbound(nl.Config.Protocol, pktBytes)
+	return syscall.Sendmsg(nl.Fd, pktBytes, nil, &destAddr, 0)
 }
 
-func (n *NetlinkPacket) UpdateDataLength(dataLen uint32) {
-	n.NlMsgHdr.Len = uint32(syscall.NLMSG_HDRLEN + 1 + 4 + dataLen)
-	n.Length = dataLen
+func (nl *NetlinkSocket) Recv() (messages []syscall.NetlinkMessage, peer *Peer, err error) {
+	var b []byte
+	if b, peer, err = recvNetlinkDatagram(nl.Fd); err != nil {
+		return
+	}
+	Capture.Inbound(nl.Config.Protocol, b)
+	return parseNetlinkDatagram(b, peer)
 }
 
-type NetlinkSocket struct {
-	Fd   int
-	Addr syscall.SockaddrNetlink
+// Close may be called more than once; sends after it fail with EBADF
+// rather than going to whatever socket reuses the fd
+func (nl *NetlinkSocket) Close() (err error) {
+	err = syscall.Close(nl.Fd)
+	nl.Fd = -1
+	return
 }
 
-func (nl *NetlinkSocket) SendString(message string) error {
-	return nl.Send([]byte(message))
+// nlmsgPad pads a message to NLMSG_ALIGNTO so that userspace peers, which
+// parse with syscall.ParseNetlinkMessage, accept it
+func nlmsgPad(b []byte) []byte {
+	if pad := (syscall.NLMSG_ALIGNTO - len(b)%syscall.NLMSG_ALIGNTO) % syscall.NLMSG_ALIGNTO; pad > 0 {
+		b = append(b, make([]byte, pad)...)
+	}
+	return b
 }
 
-func (nl *NetlinkSocket) Send(b []byte) error {
-	var destAddr syscall.SockaddrNetlink
-
-	pkt := NewNetlinkPacket()
-
-	realLength := uint32(len(b))
-
-	destAddr.Family = syscall.AF_NETLINK
-	destAddr.Pid = 0
-	destAddr.Groups = 1
-
-	SeqNum++
-	pkt.UpdateDataLength(realLength)
-	pkt.NlMsgHdr.Seq = SeqNum
-	pkt.NlMsgHdr.Pid = nl.Addr.Pid
-
-	pkt.Data = &b
-	pktBytes := pkt.Bytes()
-
-	log(fmt.Sprintf("Sending %d bytes", len(pktBytes)))
-	return syscall.Sendmsg(nl.Fd, pktBytes, nil, &destAddr, 0)
+func recvNetlinkMessages(fd int) (messages []syscall.NetlinkMessage, peer *Peer, err error) {
+	var b []byte
+	if b, peer, err = recvNetlinkDatagram(fd); err != nil {
+		return
+	}
+	return parseNetlinkDatagram(b, peer)
 }
 
-func (nl *NetlinkSocket) Recv() (messages []syscall.NetlinkMessage, err error) {
-	var nr int
+// recvNetlinkDatagram reads one datagram along with the sender's address
+// and credentials
+func recvNetlinkDatagram(fd int) (b []byte, peer *Peer, err error) {
+	var nr, oobn int
+	var from syscall.Sockaddr
+
+	// Peek at the pending datagram to learn its real size so that large
+	// batch commands are not truncated to a page.
+	size := syscall.Getpagesize()
+	if nr, _, err = syscall.Recvfrom(fd, nil, syscall.MSG_PEEK|syscall.MSG_TRUNC); err != nil {
+		return nil, nil, fmt.Errorf("Failed recvfrom(MSG_PEEK): %w", err)
+	}
+	if nr > size {
+		size = nr
+	}
 
-	b := make([]byte, syscall.Getpagesize())
-	if nr, _, err = syscall.Recvfrom(nl.Fd, b, 0); err != nil {
-		return nil, fmt.Errorf("Failed recvfrom():", err)
+	b = make([]byte, size)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofUcred))
+	if nr, oobn, _, from, err = syscall.Recvmsg(fd, b, oob, 0); err != nil {
+		return nil, nil, fmt.Errorf("Failed recvmsg(): %w", err)
+	}
+	peer = &Peer{Addr: from}
+	if cmsgs, cerr := syscall.ParseSocketControlMessage(oob[:oobn]); cerr == nil {
+		for idx := range cmsgs {
+			if creds, cerr := syscall.ParseUnixCredentials(&cmsgs[idx]); cerr == nil {
+				peer.Creds = creds
+			}
+		}
 	}
 	if nr < syscall.NLMSG_HDRLEN {
-		return nil, fmt.Errorf(fmt.Sprintf("Short message from netlink socket received=%d", nr))
+		return nil, peer, fmt.Errorf("Short message from netlink socket received=%d", nr)
 	}
 	b = b[:nr]
-	if messages, err = syscall.ParseNetlinkMessage(b); err != nil {
-		return nil, fmt.Errorf("Failed syscall.ParseNetlinkMessag():", err)
-	}
 	return
 }
 
-func NewNetlinkSocket(protocol int) (nl *NetlinkSocket, err error) {
+func parseNetlinkDatagram(b []byte, peer *Peer) ([]syscall.NetlinkMessage, *Peer, error) {
+	messages, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, peer, fmt.Errorf("Failed syscall.ParseNetlinkMessage(): %v", err)
+	}
+	return messages, peer, nil
+}
+
+func NewNetlinkSocket(config NetlinkConfig) (nl *NetlinkSocket, err error) {
 	var fd int
 	nl = new(NetlinkSocket)
-	if fd, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, protocol); err != nil {
+	nl.Config = config
+	if fd, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, config.Protocol); err != nil {
 		fd = -1
 		return
 	}
 	nl.Addr.Family = syscall.AF_NETLINK
-	nl.Addr.Pid = uint32(syscall.Getpid())
+	// With no configured port the kernel picks one: the process pid if it
+	// is free, which it is not while a reconnect still holds the old socket
+	nl.Addr.Pid = config.PortId
+	nl.Addr.Groups = config.BindGroups
 	if err = syscall.Bind(fd, &nl.Addr); err != nil {
 		syscall.Close(fd)
 		fd = -1
 		return
 	}
+	var sa syscall.Sockaddr
+	if sa, err = syscall.Getsockname(fd); err != nil {
+		syscall.Close(fd)
+		return
+	}
+	if addr, ok := sa.(*syscall.SockaddrNetlink); ok {
+		nl.Addr.Pid = addr.Pid
+	}
+	for _, group := range config.Groups {
+		if err = syscall.SetsockoptInt(fd, SOL_NETLINK, syscall.NETLINK_ADD_MEMBERSHIP, int(group)); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("Failed to join netlink group %d: %w", group, err)
+		}
+	}
+	if err = setRecvTimeout(fd, RECV_POLL_INTERVAL); err != nil {
+		syscall.Close(fd)
+		return
+	}
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1); err != nil {
+		syscall.Close(fd)
+		return
+	}
 	nl.Fd = fd
 	return
 }
 
-func InitializeNetlinkConnection() (err error) {
-	var nl *NetlinkSocket
-	if nl, err = NewNetlinkSocket(MPDECISION_COEXIST); err != nil {
-		log("Failed to open netlink socket:", err)
-		return
-	}
-	Socket = nl
+// InitializeNetlinkConnection announces the daemon to the kernel and waits
+// up to timeout for the kernel's capabilities, which the receive loop hands
+// to HelloHandler. Kernels that predate the
+// handshake never reply and are treated as legacy. Retries stop with
+// ctx.Err() once ctx is cancelled.
+func InitializeNetlinkConnection(ctx context.Context, sender *NetlinkSender, commands []string, timeout time.Duration) (err error) {
+	var reply *NetlinkCmd
+
+	backoff := NewBackoff(10*time.Millisecond, 5*time.Second)
+	hello := HelloMessage(commands)
 	for {
-		if err = Socket.SendString("hello"); err != nil {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if reply, err = sender.Request(hello, "hello", timeout); err != nil {
+			if ErrnoOf(err) == syscall.ETIMEDOUT {
+				log("No hello reply from kernel, assuming legacy kernel:", PeerCaps.String())
+				return nil
+			}
 			log("Sending hello failed:", err)
+			sleepContext(ctx, backoff.Next())
 			continue
 		} else {
 			break
 		}
 	}
+	// The receive loop has already applied the capabilities in reply
+	log(fmt.Sprintf("Kernel answered hello with '%s': %s", reply.Args, PeerCaps.String()))
 	return
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unreachableSocket fails every send like a kernel without our listener
+type unreachableSocket struct{}
+
+func (unreachableSocket) Send(m *Message) error { return syscall.ECONNREFUSED }
+
+func (unreachableSocket) Recv() ([]syscall.NetlinkMessage, *Peer, error) {
+	return nil, nil, syscall.EAGAIN
+}
+
+func (unreachableSocket) Close() error { return nil }
+
+func TestInitializeNetlinkConnectionCancel(t *testing.T) {
+	sender := NewNetlinkSender(unreachableSocket{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- InitializeNetlinkConnection(ctx, sender, LegacyCommands, time.Second) }()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("InitializeNetlinkConnection() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hello retries kept going after cancel")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	CPUSET_PREFIX  = "cs_"
+	CPUSET_DEFAULT = "cs_default"
+	CPUSET_TASKS   = "tasks"
+	CPUSET_CPUS    = "cpuset.cpus"
+	CPUSET_MEMS    = "cpuset.mems"
+
+	BG_CGROUP    = "bg_non_interactive"
+	FG_BG_CGROUP = "fg_bg"
+)
+
+/* PathLayout locates every sysfs, procfs and cgroup file the daemon
+ * touches. All paths are resolved below Root so that the daemon can run
+ * against a scratch directory tree or a vendor layout that mounts things
+ * elsewhere.
+ *
+ * Cpusets are named after the cgroup they mirror with a "cs_" prefix;
+ * "cs_default" is the root cpuset.
+ */
+type PathLayout struct {
+	Root        string `json:"root"`
+	CpusetDir   string `json:"cpuset_dir"`
+	CpuctlDir   string `json:"cpuctl_dir"`
+	TempfreqDir string `json:"tempfreq_dir"`
+	ProcDir     string `json:"proc_dir"`
+	Cgroup2Dir  string `json:"cgroup2_dir"`
+	CpuDir      string `json:"cpu_dir"`
+
+	// configured holds the json names of the fields set by the config
+	// file; DetectCgroupBackend only fills in the others
+	configured map[string]bool
+}
+
+func DefaultPathLayout() PathLayout {
+	return PathLayout{
+		Root:        "/",
+		CpusetDir:   "/sys/fs/cgroup/cpuset",
+		CpuctlDir:   "/dev/cpuctl",
+		TempfreqDir: "/sys/tempfreq",
+		ProcDir:     "/proc",
+		Cgroup2Dir:  "/sys/fs/cgroup",
+		CpuDir:      "/sys/devices/system/cpu",
+	}
+}
+
+// Configured reports whether the config file set the field with json name
+// field, e.g. "cpuset_dir"
+func (layout *PathLayout) Configured(field string) bool {
+	return layout.configured[field]
+}
+
+func (layout *PathLayout) resolve(elem ...string) string {
+	return filepath.Join(append([]string{layout.Root}, elem...)...)
+}
+
+// Cpuset is the directory of the named cpuset
+func (layout *PathLayout) Cpuset(cpuset string) string {
+	if cpuset == CPUSET_DEFAULT || cpuset == "" {
+		return layout.resolve(layout.CpusetDir)
+	}
+	return layout.resolve(layout.CpusetDir, cpuset)
+}
+
+// CpusetFile is a control file such as "tasks" or "cpuset.cpus" of a cpuset
+func (layout *PathLayout) CpusetFile(cpuset string, file string) string {
+	return filepath.Join(layout.Cpuset(cpuset), file)
+}
+
+// CgroupCpuset is the name of the cpuset mirroring a cpuctl cgroup
+func CgroupCpuset(cgroup string) string {
+	return CPUSET_PREFIX + cgroup
+}
+
+// CgroupTasks is the tasks file of a cpuctl cgroup
+func (layout *PathLayout) CgroupTasks(cgroup string) string {
+	return layout.resolve(layout.CpuctlDir, cgroup, CPUSET_TASKS)
+}
+
+// Tempfreq is a file exported by the tempfreq kernel module
+func (layout *PathLayout) Tempfreq(file string) string {
+	return layout.resolve(layout.TempfreqDir, file)
+}
+
+func (layout *PathLayout) Proc(file string) string {
+	return layout.resolve(layout.ProcDir, file)
+}
+
+// Cpu is a file of the cpu subsystem such as "online" or "possible"
+func (layout *PathLayout) Cpu(file string) string {
+	return layout.resolve(layout.CpuDir, file)
+}
+
+// CpuFile is a file below cpuN, e.g. "topology/core_id"
+func (layout *PathLayout) CpuFile(cpu int, file string) string {
+	return layout.resolve(layout.CpuDir, fmt.Sprintf("cpu%d", cpu), file)
+}
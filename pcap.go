@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+)
+
+/* PcapWriter saves netlink traffic in the format nlmon produces so that it
+ * can be opened in Wireshark (see tools/thermaplan.lua for a dissector of
+ * the command layout). Every packet starts with the 16-byte cooked header
+ * of LINKTYPE_NETLINK:
+ *
+ *   pkttype(be16) arphrd(be16)=824 addr_len(be16)=0 addr[8] protocol(be16)
+ *
+ * followed by the netlink message exactly as it went over the socket.
+ */
+const (
+	PCAP_MAGIC         uint32 = 0xa1b2c3d4
+	PCAP_VERSION_MAJOR uint16 = 2
+	PCAP_VERSION_MINOR uint16 = 4
+	PCAP_SNAPLEN       uint32 = 256 * 1024
+	LINKTYPE_NETLINK   uint32 = 253
+
+	ARPHRD_NETLINK  uint16 = 824
+	PACKET_HOST     uint16 = 0
+	PACKET_OUTGOING uint16 = 4
+
+	PCAP_COOKED_HDR_SIZE int = 16
+)
+
+// PcapWriter appends captured packets to a pcap file. A nil PcapWriter
+// captures nothing.
+type PcapWriter struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+var Capture *PcapWriter
+
+func NewPcapWriter(path string) (pw *PcapWriter, err error) {
+	var file *os.File
+	if file, err = os.Create(path); err != nil {
+		return
+	}
+	pw = new(PcapWriter)
+	pw.file = file
+	pw.writer = bufio.NewWriter(file)
+
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], PCAP_MAGIC)
+	binary.LittleEndian.PutUint16(hdr[4:6], PCAP_VERSION_MAJOR)
+	binary.LittleEndian.PutUint16(hdr[6:8], PCAP_VERSION_MINOR)
+	// thiszone and sigfigs stay 0
+	binary.LittleEndian.PutUint32(hdr[16:20], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint32(hdr[20:24], LINKTYPE_NETLINK)
+	if _, err = pw.writer.Write(hdr); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = pw.writer.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return
+}
+
+func (pw *PcapWriter) write(pktType uint16, protocol int, b []byte) {
+	if pw == nil {
+		return
+	}
+	now := time.Now()
+	length := PCAP_COOKED_HDR_SIZE + len(b)
+	captured := length
+	if uint32(captured) > PCAP_SNAPLEN {
+		captured = int(PCAP_SNAPLEN)
+	}
+
+	record := make([]byte, 16+PCAP_COOKED_HDR_SIZE)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(captured))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(length))
+	cooked := record[16:]
+	binary.BigEndian.PutUint16(cooked[0:2], pktType)
+	binary.BigEndian.PutUint16(cooked[2:4], ARPHRD_NETLINK)
+	binary.BigEndian.PutUint16(cooked[14:16], uint16(protocol))
+
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	pw.writer.Write(record)
+	pw.writer.Write(b[:captured-PCAP_COOKED_HDR_SIZE])
+	// Flush per packet so that a capture is usable if the daemon dies
+	if err := pw.writer.Flush(); err != nil {
+		log("Failed to write pcap packet:", err)
+	}
+}
+
+// Inbound captures a datagram received on a socket of the given protocol
+func (pw *PcapWriter) Inbound(protocol int, b []byte) {
+	pw.write(PACKET_HOST, protocol, b)
+}
+
+// Outbound captures a datagram sent on a socket of the given protocol
+func (pw *PcapWriter) Outbound(protocol int, b []byte) {
+	pw.write(PACKET_OUTGOING, protocol, b)
+}
+
+func (pw *PcapWriter) Close() error {
+	if pw == nil {
+		return nil
+	}
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	pw.writer.Flush()
+	return pw.file.Close()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Peer identifies who sent a batch of messages
+type Peer struct {
+	Addr  syscall.Sockaddr
+	Creds *syscall.Ucred
+}
+
+// IsKernel is true for messages sent by the kernel itself (nl_pid 0)
+func (p *Peer) IsKernel() bool {
+	nl, ok := p.Addr.(*syscall.SockaddrNetlink)
+	if !ok || nl.Pid != 0 {
+		return false
+	}
+	return p.Creds == nil || p.Creds.Pid == 0
+}
+
+func (p *Peer) String() string {
+	var addr string
+	switch sa := p.Addr.(type) {
+	case *syscall.SockaddrNetlink:
+		addr = fmt.Sprintf("port:%d", sa.Pid)
+	case *syscall.SockaddrUnix:
+		addr = fmt.Sprintf("path:%s", sa.Name)
+	default:
+		addr = fmt.Sprintf("%T", p.Addr)
+	}
+	if p.Creds != nil {
+		return fmt.Sprintf("%s pid:%d uid:%d", addr, p.Creds.Pid, p.Creds.Uid)
+	}
+	return addr
+}
+
+/* PeerPolicy decides which senders the daemon accepts commands from. The
+ * kernel is always trusted; userspace peers (e.g. kernel-sim) must match
+ * one of the allowlist entries:
+ *
+ *   port:<nl_pid>   netlink port id of the sender
+ *   path:<path>     unix socket path of the sender
+ *   uid:<uid>       uid from SCM_CREDENTIALS
+ */
+type PeerPolicy struct {
+	mutex    sync.RWMutex
+	ports    map[uint32]bool
+	paths    map[string]bool
+	uids     map[uint32]bool
+	rejected uint64
+}
+
+var TrustedPeers = NewPeerPolicy()
+
+func NewPeerPolicy() *PeerPolicy {
+	return &PeerPolicy{
+		ports: make(map[uint32]bool),
+		paths: make(map[string]bool),
+		uids:  make(map[uint32]bool),
+	}
+}
+
+func (policy *PeerPolicy) Allow(entry string) (err error) {
+	tokens := strings.SplitN(entry, ":", 2)
+	if len(tokens) != 2 || tokens[1] == "" {
+		return fmt.Errorf("Invalid trusted peer '%s': expected port:<id>, path:<path> or uid:<uid>", entry)
+	}
+
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	var id uint64
+	switch tokens[0] {
+	case "port":
+		if id, err = strconv.ParseUint(tokens[1], 10, 32); err != nil {
+			return
+		}
+		policy.ports[uint32(id)] = true
+	case "uid":
+		if id, err = strconv.ParseUint(tokens[1], 10, 32); err != nil {
+			return
+		}
+		policy.uids[uint32(id)] = true
+	case "path":
+		policy.paths[tokens[1]] = true
+	default:
+		return fmt.Errorf("Invalid trusted peer '%s': unknown kind '%s'", entry, tokens[0])
+	}
+	return
+}
+
+func (policy *PeerPolicy) Allows(peer *Peer) bool {
+	if peer.IsKernel() {
+		return true
+	}
+
+	policy.mutex.RLock()
+	defer policy.mutex.RUnlock()
+	switch sa := peer.Addr.(type) {
+	case *syscall.SockaddrNetlink:
+		if policy.ports[sa.Pid] {
+			return true
+		}
+	case *syscall.SockaddrUnix:
+		if sa.Name != "" && policy.paths[sa.Name] {
+			return true
+		}
+	}
+	if peer.Creds != nil && policy.uids[peer.Creds.Uid] {
+		return true
+	}
+	return false
+}
+
+// Check returns whether peer is trusted, counting and logging rejections
+func (policy *PeerPolicy) Check(peer *Peer) bool {
+	if policy.Allows(peer) {
+		return true
+	}
+	rejected := atomic.AddUint64(&policy.rejected, 1)
+	log(fmt.Sprintf("Rejected message from untrusted sender %v (total rejected: %d)", peer.String(), rejected))
+	return false
+}
+
+func (policy *PeerPolicy) Rejected() uint64 {
+	return atomic.LoadUint64(&policy.rejected)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
+const (
+	// Sockets wake up at least this often so the receive loop can notice
+	// that it has been asked to stop
+	RECV_POLL_INTERVAL = 500 * time.Millisecond
+
+	RESYNC_FEATURE = "resync"
+)
+
+type RecvErrorClass int
+
+const (
+	// Nothing arrived within RECV_POLL_INTERVAL
+	RECV_ERR_TIMEOUT RecvErrorClass = iota
+	// Interrupted; retry straight away
+	RECV_ERR_RETRY
+	// The socket buffer overflowed and messages were lost
+	RECV_ERR_OVERRUN
+	// The socket is unusable and must be recreated
+	RECV_ERR_FATAL
+	// Anything else; retry with backoff
+	RECV_ERR_TRANSIENT
+)
+
+func (c RecvErrorClass) String() string {
+	switch c {
+	case RECV_ERR_TIMEOUT:
+		return "timeout"
+	case RECV_ERR_RETRY:
+		return "retry"
+	case RECV_ERR_OVERRUN:
+		return "overrun"
+	case RECV_ERR_FATAL:
+		return "fatal"
+	default:
+		return "transient"
+	}
+}
+
+func ClassifyRecvError(err error) RecvErrorClass {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return RECV_ERR_TRANSIENT
+	}
+	switch errno {
+	case syscall.EAGAIN:
+		return RECV_ERR_TIMEOUT
+	case syscall.EINTR:
+		return RECV_ERR_RETRY
+	case syscall.ENOBUFS:
+		return RECV_ERR_OVERRUN
+	case syscall.EBADF, syscall.ENOTSOCK, syscall.ENOTCONN, syscall.ECONNREFUSED, syscall.EPIPE:
+		return RECV_ERR_FATAL
+	default:
+		return RECV_ERR_TRANSIENT
+	}
+}
+
+// Backoff doubles the delay on every failure up to Max
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	current time.Duration
+}
+
+func NewBackoff(min time.Duration, max time.Duration) *Backoff {
+	return &Backoff{Min: min, Max: max}
+}
+
+func (b *Backoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.Min
+	} else if b.current < b.Max {
+		b.current *= 2
+		if b.current > b.Max {
+			b.current = b.Max
+		}
+	}
+	return b.current
+}
+
+func (b *Backoff) Reset() {
+	b.current = 0
+}
+
+// sleepContext waits for d, returning early if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+func setRecvTimeout(fd int, timeout time.Duration) error {
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	return syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+}
+
+// RequestResync asks the kernel to resend its state after we lost messages
+func RequestResync(sender *NetlinkSender) error {
+	if !PeerCaps.Supports(RESYNC_FEATURE) {
+		log("Kernel does not support resync; lost messages are not recoverable")
+		return nil
+	}
+	return sender.SendString(RESYNC_FEATURE)
+}
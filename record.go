@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	RECORD_IN  = "in"
+	RECORD_OUT = "out"
+)
+
+// TrafficRecord is one line of a recording. Inbound records carry the
+// decoded command; outbound records carry the message text as sent.
+type TrafficRecord struct {
+	Time time.Time `json:"time"`
+	Dir  string    `json:"dir"`
+	Seq  uint32    `json:"seq"`
+	Cmd  string    `json:"cmd,omitempty"`
+	Args string    `json:"args,omitempty"`
+	Data string    `json:"data,omitempty"`
+}
+
+// Recorder appends kernel traffic to a JSON-lines file. A nil Recorder
+// records nothing so callers need not check whether recording is enabled.
+type Recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+var Recording *Recorder
+
+func NewRecorder(path string) (recorder *Recorder, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	recorder = new(Recorder)
+	recorder.file = file
+	recorder.encoder = json.NewEncoder(file)
+	return
+}
+
+func (recorder *Recorder) record(record *TrafficRecord) {
+	if recorder == nil {
+		return
+	}
+	record.Time = time.Now()
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if err := recorder.encoder.Encode(record); err != nil {
+		log("Failed to record traffic:", err)
+	}
+}
+
+func (recorder *Recorder) Inbound(cmd *NetlinkCmd) {
+	recorder.record(&TrafficRecord{Dir: RECORD_IN, Seq: cmd.Seq, Cmd: cmd.Cmd, Args: cmd.Args})
+}
+
+func (recorder *Recorder) Outbound(m *Message) {
+	recorder.record(&TrafficRecord{Dir: RECORD_OUT, Seq: m.Seq, Data: m.Text})
+}
+
+func (recorder *Recorder) Close() error {
+	if recorder == nil {
+		return nil
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return recorder.file.Close()
+}
+
+// ReadRecording parses a recording written by Recorder
+func ReadRecording(r io.Reader) (records []*TrafficRecord, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), NETLINK_V2_ARGS_SIZE+4096)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := new(TrafficRecord)
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	err = scanner.Err()
+	return
+}
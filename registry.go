@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type ArgType int
+
+const (
+	ARG_INT ArgType = iota
+	ARG_STRING
+	ARG_BOOL
+	ARG_CPULIST
+	// Consumes all remaining tokens; only valid as the last argument
+	ARG_INT_LIST
+	// A cgroup or cpuset directly below the hierarchy root
+	ARG_CGROUP
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case ARG_INT:
+		return "int"
+	case ARG_STRING:
+		return "string"
+	case ARG_BOOL:
+		return "bool"
+	case ARG_CPULIST:
+		return "cpulist"
+	case ARG_INT_LIST:
+		return "int..."
+	case ARG_CGROUP:
+		return "cgroup"
+	default:
+		return fmt.Sprintf("ArgType(%d)", int(t))
+	}
+}
+
+// ArgSpec describes one space separated argument of a command. Optional
+// arguments may only appear at the end of a schema.
+type ArgSpec struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+}
+
+// Args holds the parsed arguments of a command keyed by ArgSpec.Name. An
+// absent optional argument reads as the zero value of its type; use Has
+// to tell it from an explicit one.
+type Args struct {
+	values map[string]interface{}
+}
+
+func (args *Args) value(name string) interface{} {
+	if args == nil {
+		return nil
+	}
+	return args.values[name]
+}
+
+func (args *Args) Has(name string) bool {
+	return args.value(name) != nil
+}
+
+func (args *Args) Int(name string) int {
+	value, _ := args.value(name).(int)
+	return value
+}
+
+func (args *Args) String(name string) string {
+	value, _ := args.value(name).(string)
+	return value
+}
+
+func (args *Args) Bool(name string) bool {
+	value, _ := args.value(name).(bool)
+	return value
+}
+
+func (args *Args) CpuList(name string) CpuList {
+	value, _ := args.value(name).(CpuList)
+	return value
+}
+
+func (args *Args) IntList(name string) []int {
+	value, _ := args.value(name).([]int)
+	return value
+}
+
+// CommandHandler handles one command received from the kernel. Replies go
+// out through sender and the returned error is acknowledged back to the
+// kernel.
+type CommandHandler func(sender *NetlinkSender, cmd *NetlinkCmd, args *Args) error
+
+type Command struct {
+	Name    string
+	Schema  []ArgSpec
+	Handler CommandHandler
+}
+
+func (c *Command) Usage() string {
+	parts := []string{c.Name}
+	for _, spec := range c.Schema {
+		part := fmt.Sprintf("%s(%v)", spec.Name, spec.Type)
+		if spec.Optional {
+			part = "[" + part + "]"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Parse validates text against the schema. Failures are reported as EINVAL.
+func (c *Command) Parse(text string) (args *Args, err error) {
+	tokens := strings.Fields(text)
+
+	required := 0
+	for _, spec := range c.Schema {
+		if !spec.Optional {
+			required++
+		}
+	}
+	variadic := len(c.Schema) > 0 && c.Schema[len(c.Schema)-1].Type == ARG_INT_LIST
+	if len(tokens) < required || (len(tokens) > len(c.Schema) && !variadic) {
+		return nil, CommandErrorf(syscall.EINVAL, "expected: %s got: '%s'", c.Usage(), text)
+	}
+
+	args = &Args{values: make(map[string]interface{})}
+	for idx, token := range tokens {
+		if idx >= len(c.Schema)-1 && variadic {
+			spec := c.Schema[len(c.Schema)-1]
+			list := make([]int, 0, len(tokens)-idx)
+			for _, token := range tokens[idx:] {
+				var value int
+				if value, err = strconv.Atoi(token); err != nil {
+					return nil, CommandErrorf(syscall.EINVAL, "invalid %s %v: '%s'", spec.Name, spec.Type, token)
+				}
+				list = append(list, value)
+			}
+			args.values[spec.Name] = list
+			break
+		}
+		spec := c.Schema[idx]
+		var value interface{}
+		switch spec.Type {
+		case ARG_INT:
+			value, err = strconv.Atoi(token)
+		case ARG_STRING:
+			value = token
+		case ARG_BOOL:
+			value, err = strconv.ParseBool(token)
+		case ARG_CPULIST:
+			// Cpu lists are checked against the online cpus here so that
+			// handlers never write a bad list to a cgroup
+			if value, err = ParseValidCpuList(token); err != nil {
+				return nil, fmt.Errorf("%s: %w", spec.Name, err)
+			}
+		case ARG_CGROUP:
+			// Names end up in paths; keep them inside the hierarchy
+			if err = ValidateCgroupName(token); err != nil {
+				return nil, fmt.Errorf("%s: %w", spec.Name, err)
+			}
+			value = token
+		}
+		if err != nil {
+			return nil, CommandErrorf(syscall.EINVAL, "invalid %s %v: '%s'", spec.Name, spec.Type, token)
+		}
+		args.values[spec.Name] = value
+	}
+	return
+}
+
+type Registry struct {
+	mutex    sync.RWMutex
+	commands map[string]*Command
+}
+
+var Commands = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]*Command)}
+}
+
+func (r *Registry) Register(name string, schema []ArgSpec, handler CommandHandler) (err error) {
+	for idx, spec := range schema {
+		if !spec.Optional && idx > 0 && schema[idx-1].Optional {
+			return fmt.Errorf("%s: required argument '%s' follows an optional one", name, spec.Name)
+		}
+		if spec.Type == ARG_INT_LIST && idx != len(schema)-1 {
+			return fmt.Errorf("%s: list argument '%s' must be last", name, spec.Name)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.commands[name]; ok {
+		return fmt.Errorf("Command already registered: %s", name)
+	}
+	r.commands[name] = &Command{Name: name, Schema: schema, Handler: handler}
+	return
+}
+
+func (r *Registry) Lookup(name string) (c *Command, ok bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	c, ok = r.commands[name]
+	return
+}
+
+func (r *Registry) Names() (names []string) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Dispatch parses cmd against its schema and runs the registered handler.
+// Unknown commands fail with EOPNOTSUPP and bad arguments with EINVAL.
+func (r *Registry) Dispatch(sender *NetlinkSender, cmd *NetlinkCmd) (err error) {
+	c, ok := r.Lookup(cmd.Cmd)
+	if !ok {
+		return CommandErrorf(syscall.EOPNOTSUPP, "unknown command: %s", cmd.Cmd)
+	}
+	var args *Args
+	if args, err = c.Parse(cmd.Args); err != nil {
+		return
+	}
+	return c.Handler(sender, cmd, args)
+}
+
+// RegisterCommands declares every command the daemon handles
+func RegisterCommands(registry *Registry) (err error) {
+	if err = registry.Register("hello", []ArgSpec{
+		{Name: "version", Type: ARG_INT},
+		{Name: "features", Type: ARG_STRING, Optional: true},
+	}, HelloHandler); err != nil {
+		return
+	}
+	if err = registry.Register("mpdecision", []ArgSpec{
+		{Name: "block", Type: ARG_BOOL},
+	}, MpdecisionHandler); err != nil {
+		return
+	}
+	if err = registry.Register("move_to_cgroup", []ArgSpec{
+		{Name: "pid", Type: ARG_INT},
+		{Name: "cgroup", Type: ARG_CGROUP},
+		{Name: "should_assign_cpuset", Type: ARG_BOOL},
+	}, MoveToCgroupHandler); err != nil {
+		return
+	}
+	if err = registry.Register("move_tasks", []ArgSpec{
+		{Name: "cgroup", Type: ARG_CGROUP},
+		{Name: "should_assign_cpuset", Type: ARG_BOOL},
+		{Name: "pids", Type: ARG_INT_LIST},
+	}, MoveTasksHandler); err != nil {
+		return
+	}
+	if err = registry.Register("cpuset", []ArgSpec{
+		{Name: "cpuset", Type: ARG_CGROUP},
+		{Name: "pid", Type: ARG_INT},
+	}, CpusetHandler); err != nil {
+		return
+	}
+	return
+}
+
+// HandledCommands lists the commands announced to the kernel in our hello
+func HandledCommands() (commands []string) {
+	for _, name := range Commands.Names() {
+		if name != "hello" {
+			commands = append(commands, name)
+		}
+	}
+	return
+}
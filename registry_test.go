@@ -0,0 +1,74 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestArgsAbsentOptional(t *testing.T) {
+	cmd := &Command{Name: "test", Schema: []ArgSpec{
+		{Name: "pid", Type: ARG_INT},
+		{Name: "name", Type: ARG_STRING, Optional: true},
+		{Name: "flag", Type: ARG_BOOL, Optional: true},
+		{Name: "cpus", Type: ARG_CPULIST, Optional: true},
+		{Name: "pids", Type: ARG_INT_LIST, Optional: true},
+	}}
+	args, err := cmd.Parse("7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Int("pid") != 7 || !args.Has("pid") {
+		t.Fatalf("pid = %d", args.Int("pid"))
+	}
+	for _, name := range []string{"name", "flag", "cpus", "pids"} {
+		if args.Has(name) {
+			t.Errorf("Has(%s) for an absent argument", name)
+		}
+	}
+	if args.String("name") != "" || args.Bool("flag") || !args.CpuList("cpus").IsEmpty() || args.IntList("pids") != nil {
+		t.Error("absent arguments are not zero values")
+	}
+	// Wrong type and unknown names read as zero too
+	if args.String("pid") != "" || args.Int("nope") != 0 {
+		t.Error("mistyped arguments are not zero values")
+	}
+	var none *Args
+	if none.Has("pid") || none.Int("pid") != 0 {
+		t.Error("nil Args")
+	}
+}
+
+func TestRegistryDispatchErrors(t *testing.T) {
+	registry := testRegistry(t)
+	tests := []struct {
+		cmd   string
+		args  string
+		errno syscall.Errno
+	}{
+		{"unknown", "1", syscall.EOPNOTSUPP},
+		// Type errors
+		{"move_to_cgroup", "ten bg_non_interactive true", syscall.EINVAL},
+		{"move_to_cgroup", "10 bg_non_interactive maybe", syscall.EINVAL},
+		{"move_tasks", "bg_non_interactive false 1 x", syscall.EINVAL},
+		{"mpdecision", "yes", syscall.EINVAL},
+		{"hello", "v2 ack", syscall.EINVAL},
+		// Missing required and extra arguments
+		{"move_to_cgroup", "10 bg_non_interactive", syscall.EINVAL},
+		{"move_tasks", "bg_non_interactive false", syscall.EINVAL},
+		{"cpuset", "", syscall.EINVAL},
+		{"hello", "", syscall.EINVAL},
+		{"cpuset", "cs_top 1 2", syscall.EINVAL},
+		// Cgroup and cpuset names may not leave the hierarchy
+		{"move_to_cgroup", "10 ../.. false", syscall.EINVAL},
+		{"move_to_cgroup", "10 a/b true", syscall.EINVAL},
+		{"move_tasks", ". false 1 2", syscall.EINVAL},
+		{"cpuset", ".. 10", syscall.EINVAL},
+		{"cpuset", "../cs_top 10", syscall.EINVAL},
+	}
+	for _, test := range tests {
+		cmd := &NetlinkCmd{Cmd: test.cmd, Args: test.args}
+		if err := registry.Dispatch(nil, cmd); err == nil || ErrnoOf(err) != test.errno {
+			t.Errorf("Dispatch(%v) = %v, want errno %d", cmd, err, test.errno)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// ReplaySocket stands in for the kernel during a replay and keeps every
+// message the handlers send
+type ReplaySocket struct {
+	Sent []string
+}
+
+func (rs *ReplaySocket) Send(m *Message) error {
+	rs.Sent = append(rs.Sent, m.Text)
+	return nil
+}
+
+func (rs *ReplaySocket) Recv() ([]syscall.NetlinkMessage, *Peer, error) {
+	return nil, nil, syscall.EAGAIN
+}
+
+func (rs *ReplaySocket) Close() error {
+	return nil
+}
+
+/* Replay feeds the inbound commands of a recording through the handlers, one
+ * at a time in recorded order, so that a sequence seen on a device can be
+ * reproduced deterministically. The replies produced are compared with the
+ * recorded ones; hello is left out since it depends on the daemon build.
+ */
+func Replay(records []*TrafficRecord) (mismatches int, err error) {
+	socket := new(ReplaySocket)
+	sender := NewNetlinkSender(socket)
+
+	var recorded []string
+	for _, record := range records {
+		switch record.Dir {
+		case RECORD_IN:
+			cmd := &NetlinkCmd{Seq: record.Seq, Cmd: record.Cmd, Args: record.Args}
+			err := Commands.Dispatch(sender, cmd)
+			log(fmt.Sprintf("replay: %v -> %v", cmd.String(), err))
+			if cmd.Cmd != "hello" {
+				SendAck(sender, cmd, err)
+			}
+		case RECORD_OUT:
+			recorded = append(recorded, record.Data)
+		default:
+			return 0, fmt.Errorf("Unknown record direction: %s", record.Dir)
+		}
+	}
+
+	replayed := withoutHello(socket.Sent)
+	recorded = withoutHello(recorded)
+	sort.Strings(replayed)
+	sort.Strings(recorded)
+	for len(replayed) > 0 || len(recorded) > 0 {
+		switch {
+		case len(recorded) == 0 || (len(replayed) > 0 && replayed[0] < recorded[0]):
+			log(fmt.Sprintf("replay: unexpected reply '%s'", replayed[0]))
+			replayed = replayed[1:]
+		case len(replayed) == 0 || recorded[0] < replayed[0]:
+			log(fmt.Sprintf("replay: missing reply '%s'", recorded[0]))
+			recorded = recorded[1:]
+		default:
+			replayed = replayed[1:]
+			recorded = recorded[1:]
+			continue
+		}
+		mismatches++
+	}
+	return
+}
+
+func withoutHello(messages []string) (filtered []string) {
+	for _, message := range messages {
+		if !strings.HasPrefix(message, "hello ") {
+			filtered = append(filtered, message)
+		}
+	}
+	return
+}
+
+// ReplayMain replays the recording at path
+func ReplayMain(path string) (err error) {
+	var file *os.File
+	var records []*TrafficRecord
+	var mismatches int
+
+	if file, err = os.Open(path); err != nil {
+		return
+	}
+	defer file.Close()
+	if records, err = ReadRecording(file); err != nil {
+		return fmt.Errorf("Failed to read recording '%s': %w", path, err)
+	}
+	if err = RegisterCommands(Commands); err != nil {
+		return
+	}
+	if mismatches, err = Replay(records); err != nil {
+		return
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("replay: %d replies differ from the recording", mismatches)
+	}
+	log(fmt.Sprintf("replay: %d records replayed, replies match", len(records)))
+	return
+}
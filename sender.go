@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type pendingRequest struct {
+	replyCmd string
+	reply    chan *NetlinkCmd
+}
+
+/* NetlinkSender is the only writer to a transport. It serializes sends,
+ * stamps each message with a sequence number and keeps track of requests
+ * awaiting a reply.
+ *
+ * A reply is a command from the kernel that carries the sequence number of
+ * the request and the command name the request asked for; the receive loop
+ * hands every command to Deliver before dispatching it.
+ */
+type NetlinkSender struct {
+	transport SocketInterface
+	sendMutex sync.Mutex
+	seq       uint32
+
+	pendingMutex sync.Mutex
+	pending      map[uint32]*pendingRequest
+}
+
+func NewNetlinkSender(transport SocketInterface) (sender *NetlinkSender) {
+	sender = new(NetlinkSender)
+	sender.transport = transport
+	sender.pending = make(map[uint32]*pendingRequest)
+	return
+}
+
+func (sender *NetlinkSender) nextSeq() uint32 {
+	return atomic.AddUint32(&sender.seq, 1)
+}
+
+func (sender *NetlinkSender) send(m *Message) error {
+	sender.sendMutex.Lock()
+	defer sender.sendMutex.Unlock()
+	Recording.Outbound(m)
+	return sender.transport.Send(m)
+}
+
+// Send stamps m with the next sequence number and writes it
+func (sender *NetlinkSender) Send(m *Message) (seq uint32, err error) {
+	m.Seq = sender.nextSeq()
+	err = sender.send(m)
+	return m.Seq, err
+}
+
+func (sender *NetlinkSender) SendString(message string) error {
+	_, err := sender.Send(NewReply(message))
+	return err
+}
+
+// Request sends message and waits up to timeout for the kernel to answer
+// with a replyCmd command carrying the same sequence number.
+func (sender *NetlinkSender) Request(message string, replyCmd string, timeout time.Duration) (reply *NetlinkCmd, err error) {
+	seq := sender.nextSeq()
+	request := &pendingRequest{replyCmd: replyCmd, reply: make(chan *NetlinkCmd, 1)}
+
+	sender.pendingMutex.Lock()
+	sender.pending[seq] = request
+	sender.pendingMutex.Unlock()
+
+	defer func() {
+		sender.pendingMutex.Lock()
+		delete(sender.pending, seq)
+		sender.pendingMutex.Unlock()
+	}()
+
+	m := NewReply(message)
+	m.Seq = seq
+	if err = sender.send(m); err != nil {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply = <-request.reply:
+	case <-timer.C:
+		err = CommandErrorf(syscall.ETIMEDOUT, "no '%s' reply to seq %d after %v", replyCmd, seq, timeout)
+	}
+	return
+}
+
+// Deliver completes the outstanding request cmd answers, if any. It returns
+// false if cmd is not a reply and should be dispatched as usual.
+func (sender *NetlinkSender) Deliver(cmd *NetlinkCmd) bool {
+	sender.pendingMutex.Lock()
+	request, ok := sender.pending[cmd.Seq]
+	if ok && request.replyCmd == cmd.Cmd {
+		delete(sender.pending, cmd.Seq)
+	} else {
+		ok = false
+	}
+	sender.pendingMutex.Unlock()
+
+	if ok {
+		request.reply <- cmd
+	}
+	return ok
+}
+
+// Outstanding is the number of requests still waiting for a reply
+func (sender *NetlinkSender) Outstanding() int {
+	sender.pendingMutex.Lock()
+	defer sender.pendingMutex.Unlock()
+	return len(sender.pending)
+}
+
+func (sender *NetlinkSender) Recv() ([]syscall.NetlinkMessage, *Peer, error) {
+	sender.sendMutex.Lock()
+	transport := sender.transport
+	sender.sendMutex.Unlock()
+	return transport.Recv()
+}
+
+// Decode extracts the command carried by message, using the transport's own
+// decoder when it has one
+func (sender *NetlinkSender) Decode(message syscall.NetlinkMessage) (*NetlinkCmd, error) {
+	sender.sendMutex.Lock()
+	transport := sender.transport
+	sender.sendMutex.Unlock()
+	if decoder, ok := transport.(CommandDecoder); ok {
+		return decoder.DecodeCommand(message)
+	}
+	var m Message
+	if err := m.Unmarshal(message, MESSAGE_COMMAND, Codec); err != nil {
+		return nil, err
+	}
+	return &m.Cmd, nil
+}
+
+// Reset switches to a new transport, e.g. after a reconnect, and returns
+// the old one. Requests outstanding on the old transport will time out.
+func (sender *NetlinkSender) Reset(transport SocketInterface) (old SocketInterface) {
+	sender.sendMutex.Lock()
+	defer sender.sendMutex.Unlock()
+	old = sender.transport
+	sender.transport = transport
+	return
+}
+
+func (sender *NetlinkSender) Close() error {
+	sender.sendMutex.Lock()
+	defer sender.sendMutex.Unlock()
+	return sender.transport.Close()
+}
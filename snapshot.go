@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Control files kept in a snapshot, in the order they are restored: a v1
+// cpuset needs mems before cpus and both before exclusivity
+var SNAPSHOT_FILES = []string{CPUSET_MEMS, CPUSET_CPUS, CPUSET_CPU_EXCLUSIVE, CPUSET_PARTITION, CPU_SHARES, CPU_WEIGHT}
+
+const (
+	// PROC_BOOT_ID changes on every boot
+	PROC_BOOT_ID = "sys/kernel/random/boot_id"
+	// Field of /proc/<pid>/stat holding the start time in clock ticks
+	// since boot, counting from 1 like proc(5)
+	PROC_STAT_STARTTIME = 22
+	PROC_STAT_FIELDS    = 52
+)
+
+/* CgroupSnapshot is the state of the cpuset and cpuctl hierarchies (or the
+ * unified hierarchy with cgroup v2): every cgroup with its control files
+ * and member tids. It is saved as JSON:
+ *
+ *   {"time": "...", "boot_id": "...", "cgroup": "v1", "hierarchies": [
+ *     {"name": "cpuset", "root": "/sys/fs/cgroup/cpuset", "groups": [
+ *       {"path": ".", "files": {"cpuset.cpus": "0-3", ...}, "tasks_file": "tasks",
+ *        "tasks": [{"tid": 1, "start": 3}, {"tid": 2, "start": 3}]},
+ *       {"path": "cs_bg_non_interactive", ...}]},
+ *     {"name": "cpuctl", ...}]}
+ *
+ * A tid only names the same task while it lives, so each one is kept with
+ * its start time and the snapshot with the boot it was taken in.
+ */
+type CgroupSnapshot struct {
+	Time        time.Time           `json:"time"`
+	BootId      string              `json:"boot_id"`
+	Cgroup      string              `json:"cgroup"`
+	Hierarchies []HierarchySnapshot `json:"hierarchies"`
+}
+
+type HierarchySnapshot struct {
+	Name   string          `json:"name"`
+	Root   string          `json:"root"`
+	Groups []GroupSnapshot `json:"groups"`
+}
+
+type GroupSnapshot struct {
+	// Path is relative to the hierarchy root, "." for the root itself
+	Path      string            `json:"path"`
+	Files     map[string]string `json:"files"`
+	TasksFile string            `json:"tasks_file"`
+	Tasks     []TaskSnapshot    `json:"tasks"`
+}
+
+type TaskSnapshot struct {
+	Tid int `json:"tid"`
+	// Start is the start time from /proc/<tid>/stat
+	Start uint64 `json:"start"`
+}
+
+func readBootId() (id string, err error) {
+	var b []byte
+	if b, err = Fs.ReadFile(Settings.Paths.Proc(PROC_BOOT_ID)); err != nil {
+		return
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// taskStartTime reads the start time of tid from /proc/<tid>/stat
+func taskStartTime(tid int) (start uint64, err error) {
+	var b []byte
+	path := Settings.Paths.Proc(filepath.Join(strconv.Itoa(tid), "stat"))
+	if b, err = Fs.ReadFile(path); err != nil {
+		return
+	}
+	// comm may hold spaces and parentheses; the fields after it do not
+	stat := string(b)
+	idx := strings.LastIndexByte(stat, ')')
+	if idx < 0 {
+		return 0, fmt.Errorf("Bad stat in %s", path)
+	}
+	// Fields after comm start with the third one, state
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) < PROC_STAT_STARTTIME-2 {
+		return 0, fmt.Errorf("Short stat in %s", path)
+	}
+	if start, err = strconv.ParseUint(fields[PROC_STAT_STARTTIME-3], 10, 64); err != nil {
+		return 0, fmt.Errorf("Bad start time in %s: %w", path, err)
+	}
+	return
+}
+
+// CheckBoot fails if snapshot was taken before the current boot, when its
+// tids named tasks that are gone
+func (snapshot *CgroupSnapshot) CheckBoot() (err error) {
+	var bootId string
+	if bootId, err = readBootId(); err != nil {
+		return fmt.Errorf("Failed to read boot id: %w", err)
+	}
+	if snapshot.BootId != bootId {
+		return fmt.Errorf("Snapshot taken %v is from an earlier boot (boot id '%s', now '%s')", snapshot.Time, snapshot.BootId, bootId)
+	}
+	return
+}
+
+// snapshotRoots lists the hierarchies of the current backend by name
+func snapshotRoots() (names []string, roots []string) {
+	layout := &Settings.Paths
+	if Cgroups.Version() == CGROUP_V2 {
+		return []string{"unified"}, []string{layout.resolve(layout.Cgroup2Dir)}
+	}
+	return []string{"cpuset", "cpuctl"}, []string{layout.Cpuset(CPUSET_DEFAULT), layout.resolve(layout.CpuctlDir)}
+}
+
+// groupTasksFile is the file listing, and taking, the members of dir
+func groupTasksFile(dir string) string {
+	if Cgroups.Version() == CGROUP_V2 {
+		return filepath.Base(CgroupV2{}.threadsFile(dir))
+	}
+	return CPUSET_TASKS
+}
+
+// walkCgroups lists root and every cgroup below it, parents first
+func walkCgroups(root string) (paths []string, err error) {
+	var walk func(rel string) error
+	walk = func(rel string) (err error) {
+		var names []string
+		paths = append(paths, rel)
+		if names, err = Fs.ReadDir(filepath.Join(root, rel)); err != nil {
+			return
+		}
+		for _, name := range names {
+			var info os.FileInfo
+			child := filepath.Join(rel, name)
+			if info, err = Fs.Stat(filepath.Join(root, child)); err != nil {
+				return
+			}
+			if info.IsDir() {
+				if err = walk(child); err != nil {
+					return
+				}
+			}
+		}
+		return
+	}
+	err = walk(".")
+	return
+}
+
+func readTids(path string) (tids []int, err error) {
+	var b []byte
+	if b, err = Fs.ReadFile(path); err != nil {
+		return
+	}
+	for _, field := range strings.Fields(string(b)) {
+		var tid int
+		if tid, err = strconv.Atoi(field); err != nil {
+			return nil, fmt.Errorf("Bad tid '%s' in %s", field, path)
+		}
+		tids = append(tids, tid)
+	}
+	return
+}
+
+func TakeSnapshot() (snapshot *CgroupSnapshot, err error) {
+	snapshot = &CgroupSnapshot{Time: time.Now(), Cgroup: Cgroups.Version()}
+	if snapshot.BootId, err = readBootId(); err != nil {
+		return nil, fmt.Errorf("Failed to read boot id: %w", err)
+	}
+	names, roots := snapshotRoots()
+	for idx, root := range roots {
+		var paths []string
+		hierarchy := HierarchySnapshot{Name: names[idx], Root: root}
+		if paths, err = walkCgroups(root); err != nil {
+			return nil, fmt.Errorf("Failed to walk %s: %w", root, err)
+		}
+		for _, rel := range paths {
+			dir := filepath.Join(root, rel)
+			group := GroupSnapshot{Path: rel, Files: make(map[string]string), TasksFile: groupTasksFile(dir)}
+			for _, file := range SNAPSHOT_FILES {
+				if b, err := Fs.ReadFile(filepath.Join(dir, file)); err == nil {
+					group.Files[file] = strings.TrimSpace(string(b))
+				}
+			}
+			var tids []int
+			if tids, err = readTids(filepath.Join(dir, group.TasksFile)); err != nil {
+				return nil, err
+			}
+			for _, tid := range tids {
+				// Tids that exit while we walk are left out
+				if start, err := taskStartTime(tid); err == nil {
+					group.Tasks = append(group.Tasks, TaskSnapshot{Tid: tid, Start: start})
+				}
+			}
+			hierarchy.Groups = append(hierarchy.Groups, group)
+		}
+		snapshot.Hierarchies = append(snapshot.Hierarchies, hierarchy)
+	}
+	return
+}
+
+func (snapshot *CgroupSnapshot) Save(path string) (err error) {
+	var data []byte
+	if data, err = json.MarshalIndent(snapshot, "", "  "); err != nil {
+		return
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func LoadSnapshot(path string) (snapshot *CgroupSnapshot, err error) {
+	var data []byte
+	if data, err = os.ReadFile(path); err != nil {
+		return
+	}
+	snapshot = new(CgroupSnapshot)
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("Failed to parse snapshot '%s': %w", path, err)
+	}
+	return
+}
+
+/* Restore puts every hierarchy back the way the snapshot found it:
+ *
+ *   1. cgroups missing now are created
+ *   2. control files that differ are written, except values that empty a
+ *      cpuset, which would stop it from taking tasks
+ *   3. tids are moved back; tids that have exited, or whose start time
+ *      shows the tid now belongs to another task, are skipped
+ *   4. the values left out in step 2 are written
+ *   5. cgroups created since the snapshot are drained into the root and
+ *      removed
+ *
+ * Snapshots from an earlier boot are refused. Restore keeps going past
+ * other errors and returns the first one.
+ */
+func (snapshot *CgroupSnapshot) Restore() (err error) {
+	if snapshot.Cgroup != Cgroups.Version() {
+		return fmt.Errorf("Snapshot is of cgroup %s but cgroup %s is in use", snapshot.Cgroup, Cgroups.Version())
+	}
+	if err = snapshot.CheckBoot(); err != nil {
+		return
+	}
+	fail := func(e error) {
+		log("Restore:", e)
+		if err == nil {
+			err = e
+		}
+	}
+	for idx := range snapshot.Hierarchies {
+		hierarchy := &snapshot.Hierarchies[idx]
+		groups := hierarchy.Groups
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].Path < groups[j].Path })
+
+		for _, group := range groups {
+			dir := filepath.Join(hierarchy.Root, group.Path)
+			if _, e := Fs.Stat(dir); e == nil {
+				continue
+			}
+			if DryRun {
+				log("Dry run: would create", dir)
+			} else if e := Fs.Mkdir(dir); e != nil {
+				fail(fmt.Errorf("Failed to create %s: %w", dir, e))
+			}
+		}
+
+		restoreFiles := func(empty bool) {
+			for _, group := range groups {
+				dir := filepath.Join(hierarchy.Root, group.Path)
+				for _, file := range SNAPSHOT_FILES {
+					value, ok := group.Files[file]
+					if !ok || (value == "") != empty {
+						continue
+					}
+					path := filepath.Join(dir, file)
+					if b, e := Fs.ReadFile(path); e == nil && strings.TrimSpace(string(b)) == value {
+						continue
+					}
+					if e := write(path, value); e != nil {
+						fail(fmt.Errorf("Failed to restore '%s' to %s: %w", value, path, e))
+					}
+				}
+			}
+		}
+		restoreFiles(false)
+
+		for _, group := range groups {
+			dir := filepath.Join(hierarchy.Root, group.Path)
+			tasksFile := filepath.Join(dir, group.TasksFile)
+			current, _ := readTids(tasksFile)
+			members := make(map[int]bool)
+			for _, tid := range current {
+				members[tid] = true
+			}
+			moved := 0
+			for _, task := range group.Tasks {
+				if members[task.Tid] {
+					continue
+				}
+				if start, e := taskStartTime(task.Tid); e != nil || start != task.Start {
+					log(fmt.Sprintf("Restore: skipping tid %d, it exited or was reused", task.Tid))
+					continue
+				}
+				if e := restoreTid(tasksFile, task.Tid); e != nil {
+					fail(fmt.Errorf("Failed to move tid %d to %s: %w", task.Tid, tasksFile, e))
+					continue
+				}
+				moved++
+			}
+			if moved > 0 {
+				log(fmt.Sprintf("Restore: moved %d tasks to %s", moved, dir))
+			}
+		}
+
+		restoreFiles(true)
+
+		if e := removeExtraCgroups(hierarchy); e != nil {
+			fail(e)
+		}
+	}
+	return
+}
+
+// restoreTid moves tid into tasksFile; tids that have exited are ignored
+func restoreTid(tasksFile string, tid int) (err error) {
+	if DryRun {
+		log(fmt.Sprintf("Dry run: would write '%d' to %s", tid, tasksFile))
+		return
+	}
+	if err = Fs.WriteFile(tasksFile, []byte(strconv.Itoa(tid))); errors.Is(err, syscall.ESRCH) {
+		err = nil
+	}
+	return
+}
+
+// removeExtraCgroups removes the cgroups of hierarchy.Root that are not in
+// the snapshot, children first
+func removeExtraCgroups(hierarchy *HierarchySnapshot) (err error) {
+	var paths []string
+	known := make(map[string]bool)
+	for _, group := range hierarchy.Groups {
+		known[group.Path] = true
+	}
+	if paths, err = walkCgroups(hierarchy.Root); err != nil {
+		return fmt.Errorf("Failed to walk %s: %w", hierarchy.Root, err)
+	}
+	rootTasks := filepath.Join(hierarchy.Root, groupTasksFile(hierarchy.Root))
+	for idx := len(paths) - 1; idx >= 0; idx-- {
+		var tids []int
+		if known[paths[idx]] {
+			continue
+		}
+		dir := filepath.Join(hierarchy.Root, paths[idx])
+		if tids, err = readTids(filepath.Join(dir, groupTasksFile(dir))); err != nil {
+			return
+		}
+		for _, tid := range tids {
+			if err = restoreTid(rootTasks, tid); err != nil {
+				return fmt.Errorf("Failed to drain tid %d from %s: %w", tid, dir, err)
+			}
+		}
+		if DryRun {
+			log("Dry run: would remove", dir)
+			continue
+		}
+		if err = Fs.Remove(dir); err != nil {
+			return fmt.Errorf("Failed to remove %s: %w", dir, err)
+		}
+		log("Restore: removed", dir)
+	}
+	return
+}
+
+// SnapshotMain saves the current cgroup state to path
+func SnapshotMain(path string) (err error) {
+	var snapshot *CgroupSnapshot
+	if snapshot, err = TakeSnapshot(); err != nil {
+		return
+	}
+	if err = snapshot.Save(path); err != nil {
+		return
+	}
+	log(fmt.Sprintf("Saved cgroup snapshot to %s", path))
+	return
+}
+
+// RestoreMain restores the cgroup state saved at path
+func RestoreMain(path string) (err error) {
+	var snapshot *CgroupSnapshot
+	if snapshot, err = LoadSnapshot(path); err != nil {
+		return
+	}
+	if err = snapshot.Restore(); err != nil {
+		return
+	}
+	log(fmt.Sprintf("Restored cgroup snapshot from %s (taken %v)", path, snapshot.Time))
+	return
+}
+
+// DaemonSnapshot is the snapshot the daemon restores on shutdown. A file
+// left at path by a daemon that did not shut down cleanly in this boot is
+// reused, since it still holds the state from before any daemon touched
+// the cgroups; otherwise a new snapshot is taken and saved there.
+func DaemonSnapshot(path string) (snapshot *CgroupSnapshot, err error) {
+	if _, err = os.Stat(path); err == nil {
+		if snapshot, err = LoadSnapshot(path); err != nil {
+			return
+		}
+		if err = snapshot.CheckBoot(); err == nil {
+			log(fmt.Sprintf("Reusing cgroup snapshot %s (taken %v)", path, snapshot.Time))
+			return
+		}
+		log(fmt.Sprintf("WARNING: discarding cgroup snapshot %s: %v", path, err))
+	}
+	if err = SnapshotMain(path); err != nil {
+		return
+	}
+	return LoadSnapshot(path)
+}
+
+// RestoreDaemonSnapshot restores snapshot and removes its file, which is
+// kept if the restore fails so that it can be retried with "restore"
+func RestoreDaemonSnapshot(snapshot *CgroupSnapshot, path string) {
+	log("Restoring cgroup snapshot", path)
+	if err := snapshot.Restore(); err != nil {
+		log(fmt.Sprintf("Failed to restore cgroup snapshot %s: %v", path, err))
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log(fmt.Sprintf("Failed to remove cgroup snapshot %s: %v", path, err))
+	}
+}
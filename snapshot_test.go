@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// snapshotBgTasks takes a snapshot with pids 10 and 11 in the bg cpuset,
+// then moves them back to the root
+func snapshotBgTasks(t *testing.T) *CgroupSnapshot {
+	layout := &Settings.Paths
+	bg := CgroupCpuset(BG_CGROUP)
+	Fs.WriteFile(layout.CpusetFile(bg, CPUSET_CPUS), []byte("0"))
+	Fs.WriteFile(layout.CpusetFile(bg, CPUSET_MEMS), []byte("0"))
+	for _, pid := range []string{"10", "11"} {
+		if err := Fs.WriteFile(layout.CpusetFile(bg, CPUSET_TASKS), []byte(pid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot, err := TakeSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pid := range []string{"10", "11"} {
+		if err := Fs.WriteFile(layout.CpusetFile(CPUSET_DEFAULT, CPUSET_TASKS), []byte(pid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return snapshot
+}
+
+func TestRestoreSkipsReusedPids(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V1)
+	mfs.AddPid(10)
+	mfs.AddPid(11)
+	snapshot := snapshotBgTasks(t)
+
+	// 11 exits and its pid goes to an unrelated process
+	mfs.RemovePid(11)
+	mfs.AddPid(11)
+	if err := snapshot.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	bgTasks := Settings.Paths.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_TASKS)
+	if got := strings.TrimSpace(readString(t, bgTasks)); got != "10" {
+		t.Fatalf("bg tasks = %q, want 10", got)
+	}
+}
+
+func TestRestoreRefusesOtherBoot(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V1)
+	mfs.AddPid(10)
+	mfs.AddPid(11)
+	snapshot := snapshotBgTasks(t)
+
+	snapshot.BootId = "from-an-earlier-boot"
+	if err := snapshot.Restore(); err == nil || !strings.Contains(err.Error(), "earlier boot") {
+		t.Fatalf("Restore() = %v, want an earlier boot error", err)
+	}
+	bgTasks := Settings.Paths.CpusetFile(CgroupCpuset(BG_CGROUP), CPUSET_TASKS)
+	if got := readString(t, bgTasks); got != "" {
+		t.Fatalf("bg tasks = %q, want none", got)
+	}
+}
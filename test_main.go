@@ -1,19 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"strings"
 	"syscall"
+	"time"
 )
 
-func NetlinkRecvHandler() {
+func NetlinkRecvHandler(transport SocketInterface) {
 	var messages []syscall.NetlinkMessage
 	var err error
 
 	log("Starting NetlinkRecvHandler()")
 	for {
-		if messages, err = Socket.Recv(); err != nil {
+		if messages, _, err = transport.Recv(); err != nil {
 			log("Failed recv:", err)
 		}
 		for m := range messages {
@@ -33,10 +35,16 @@ func NetlinkRecvHandler() {
 
 func main() {
 	var err error
+	var socket SocketInterface
 
 	init_logger()
 	log("Attempting to initialize netlink socket ...")
-	if err = InitializeNetlinkConnection(); err != nil {
+	if socket, err = NewTransport(TRANSPORT_NETLINK); err != nil {
+		log("Failed to open netlink socket:", err)
+		return
+	}
+	defer socket.Close()
+	if err = InitializeNetlinkConnection(context.Background(), NewNetlinkSender(socket), LegacyCommands, time.Second); err != nil {
 		log("Failed to initialize netlink socket:", err)
 		return
 	} else {
@@ -44,12 +52,12 @@ func main() {
 	}
 	/*
 		if len(os.Args) == 2 {
-			if err = Socket.SendString(os.Args[1]); err != nil {
+			if err = NewNetlinkSender(socket).SendString(os.Args[1]); err != nil {
 				log(fmt.Sprintf("Failed to send '%s': %v", os.Args[1], err))
 			} else {
 				log("Successfully sent message")
 			}
 		}
 	*/
-	//	NetlinkRecvHandler()
+	//	NetlinkRecvHandler(socket)
 }
@@ -0,0 +1,97 @@
+-- Wireshark dissector for thermaplan commands carried over NETLINK_USERSOCK.
+-- Open a capture written with --pcap and load this file with
+--
+--   wireshark -X lua_script:tools/thermaplan.lua capture.pcap
+--
+-- Commands from the kernel use the codec layout (V1 fixed-width or V2
+-- variable-length); messages from the daemon are "@" len(u32) text. The
+-- direction recorded in the capture tells them apart, since a V1 command
+-- may start with "@" too; the "@" is only trusted without a direction.
+-- All integers are little-endian.
+
+local thermaplan = Proto("thermaplan", "ThermaPlan netlink commands")
+
+local NLMSG_HDRLEN = 16
+local VERSION_MARKER = 0xffffffff
+
+local f = thermaplan.fields
+f.nl_len = ProtoField.uint32("thermaplan.nl_len", "Length")
+f.nl_type = ProtoField.uint16("thermaplan.nl_type", "Type")
+f.nl_flags = ProtoField.uint16("thermaplan.nl_flags", "Flags", base.HEX)
+f.nl_seq = ProtoField.uint32("thermaplan.seq", "Sequence")
+f.nl_pid = ProtoField.uint32("thermaplan.pid", "Port id")
+f.marker = ProtoField.uint32("thermaplan.marker", "Version marker", base.HEX)
+f.version = ProtoField.uint32("thermaplan.version", "Protocol version")
+f.real_len = ProtoField.uint32("thermaplan.real_len", "Real length")
+f.cmd_len = ProtoField.uint32("thermaplan.cmd_len", "Command length")
+f.cmd = ProtoField.string("thermaplan.cmd", "Command")
+f.args_len = ProtoField.uint32("thermaplan.args_len", "Arguments length")
+f.args = ProtoField.string("thermaplan.args", "Arguments")
+f.reply_len = ProtoField.uint32("thermaplan.reply_len", "Reply length")
+f.reply = ProtoField.string("thermaplan.reply", "Reply")
+
+local function dissect_command(tvb, tree)
+	if tvb(0, 4):le_uint() ~= VERSION_MARKER then
+		tree:add_le(f.real_len, tvb(0, 4))
+		local cmd_len = tvb(4, 4):le_uint()
+		tree:add_le(f.cmd_len, tvb(4, 4))
+		tree:add(f.cmd, tvb(8, cmd_len))
+		local args_len = tvb(32, 4):le_uint()
+		tree:add_le(f.args_len, tvb(32, 4))
+		tree:add(f.args, tvb(36, args_len))
+		return tvb(8, cmd_len):string(), tvb(36, args_len):string()
+	end
+	tree:add_le(f.marker, tvb(0, 4))
+	tree:add_le(f.version, tvb(4, 4))
+	local cmd_len = tvb(8, 4):le_uint()
+	local args_len = tvb(12, 4):le_uint()
+	tree:add_le(f.cmd_len, tvb(8, 4))
+	tree:add_le(f.args_len, tvb(12, 4))
+	tree:add(f.cmd, tvb(16, cmd_len))
+	if args_len > 0 then
+		tree:add(f.args, tvb(16 + cmd_len, args_len))
+	end
+	return tvb(16, cmd_len):string(), args_len > 0 and tvb(16 + cmd_len, args_len):string() or ""
+end
+
+function thermaplan.dissector(tvb, pinfo, tree)
+	pinfo.cols.protocol = "ThermaPlan"
+	local offset = 0
+	local summary = {}
+	while tvb:len() - offset >= NLMSG_HDRLEN do
+		local msg_len = tvb(offset, 4):le_uint()
+		if msg_len < NLMSG_HDRLEN or offset + msg_len > tvb:len() then
+			break
+		end
+		local msg = tvb(offset, msg_len)
+		local subtree = tree:add(thermaplan, msg)
+		subtree:add_le(f.nl_len, msg(0, 4))
+		subtree:add_le(f.nl_type, msg(4, 2))
+		subtree:add_le(f.nl_flags, msg(6, 2))
+		subtree:add_le(f.nl_seq, msg(8, 4))
+		subtree:add_le(f.nl_pid, msg(12, 4))
+
+		local body = msg_len > NLMSG_HDRLEN and msg(NLMSG_HDRLEN):tvb() or nil
+		local is_reply = pinfo.p2p_dir == P2P_DIR_SENT
+		if pinfo.p2p_dir == P2P_DIR_UNKNOWN and body ~= nil then
+			is_reply = body(0, 1):string() == "@"
+		end
+		if body == nil then
+			table.insert(summary, "empty")
+		elseif is_reply and body:len() >= 5 then
+			local reply_len = body(1, 4):le_uint()
+			subtree:add_le(f.reply_len, body(1, 4))
+			subtree:add(f.reply, body(5, reply_len))
+			table.insert(summary, "reply: " .. body(5, reply_len):string())
+		elseif not is_reply and body:len() >= 16 then
+			local cmd, args = dissect_command(body, subtree)
+			table.insert(summary, cmd .. " " .. args)
+		end
+		offset = offset + math.floor((msg_len + 3) / 4) * 4
+	end
+	pinfo.cols.info = table.concat(summary, "; ")
+	return offset
+end
+
+-- NETLINK_USERSOCK
+DissectorTable.get("netlink.protocol"):add(2, thermaplan)
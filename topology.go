@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Topology describes the cpus of the device as exported by
+ *
+ *   /sys/devices/system/cpu/cpuN/topology/{core_id,cluster_id,physical_package_id,core_siblings_list}
+ *   /sys/devices/system/cpu/cpuN/cpufreq/{related_cpus,cpuinfo_max_freq}
+ *
+ * Cpus are grouped into clusters by their cpufreq domain (related_cpus),
+ * which is what separates the big and LITTLE cores, falling back to
+ * core_siblings_list and then the cluster or package id. Clusters are
+ * ordered from the slowest to the fastest.
+ *
+ * Files missing from sysfs, e.g. cpufreq of an offline cpu, are tolerated.
+ */
+type Topology struct {
+	Possible CpuList
+	Online   CpuList
+	Cpus     []TopologyCpu
+	Clusters []Cluster
+}
+
+type TopologyCpu struct {
+	Id      int
+	CoreId  int
+	Cluster int // index into Topology.Clusters
+	Online  bool
+	// MaxFreq is cpuinfo_max_freq in kHz; 0 if unknown
+	MaxFreq uint64
+}
+
+type Cluster struct {
+	Cpus    CpuList
+	MaxFreq uint64
+}
+
+func readTopologyInt(cpu int, file string) (value int, ok bool) {
+	b, err := Fs.ReadFile(Settings.Paths.CpuFile(cpu, file))
+	if err != nil {
+		return
+	}
+	if value, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+		return
+	}
+	return value, true
+}
+
+func readTopologyCpuList(cpu int, file string) (list CpuList, ok bool) {
+	var err error
+	if list, err = readCpuList(Settings.Paths.CpuFile(cpu, file)); err != nil || list.IsEmpty() {
+		return CpuList{}, false
+	}
+	return list, true
+}
+
+func DiscoverTopology() (topology *Topology, err error) {
+	topology = new(Topology)
+	if topology.Possible, err = PossibleCpus(); err != nil {
+		return nil, fmt.Errorf("Failed to read possible cpus: %w", err)
+	}
+	if topology.Online, err = OnlineCpus(); err != nil {
+		return nil, fmt.Errorf("Failed to read online cpus: %w", err)
+	}
+
+	var clusters []Cluster
+	// Clusters of cpus without a cpufreq domain or siblings list, by id
+	byId := make(map[int]int)
+	clusterOf := make(map[int]int)
+	for _, id := range topology.Possible.Cpus() {
+		cpu := TopologyCpu{Id: id, Online: topology.Online.Contains(id)}
+		cpu.CoreId, _ = readTopologyInt(id, "topology/core_id")
+		if freq, ok := readTopologyInt(id, "cpufreq/cpuinfo_max_freq"); ok {
+			cpu.MaxFreq = uint64(freq)
+		}
+
+		idx, assigned := clusterOf[id]
+		if !assigned {
+			domain, ok := readTopologyCpuList(id, "cpufreq/related_cpus")
+			if !ok {
+				domain, ok = readTopologyCpuList(id, "topology/core_siblings_list")
+			}
+			if ok {
+				idx = len(clusters)
+				clusters = append(clusters, Cluster{})
+				for _, sibling := range domain.Union(NewCpuList(id)).Intersection(topology.Possible).Cpus() {
+					if _, taken := clusterOf[sibling]; !taken {
+						clusterOf[sibling] = idx
+					}
+				}
+			} else {
+				clusterId, ok := readTopologyInt(id, "topology/cluster_id")
+				if !ok {
+					clusterId, _ = readTopologyInt(id, "topology/physical_package_id")
+				}
+				if idx, ok = byId[clusterId]; !ok {
+					idx = len(clusters)
+					clusters = append(clusters, Cluster{})
+					byId[clusterId] = idx
+				}
+				clusterOf[id] = idx
+			}
+		}
+		cluster := &clusters[idx]
+		cluster.Cpus = cluster.Cpus.Union(NewCpuList(id))
+		if cpu.MaxFreq > cluster.MaxFreq {
+			cluster.MaxFreq = cpu.MaxFreq
+		}
+		cpu.Cluster = idx
+		topology.Cpus = append(topology.Cpus, cpu)
+	}
+
+	// Order clusters from slowest to fastest and renumber the cpus
+	order := make([]int, len(clusters))
+	for idx := range order {
+		order[idx] = idx
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := &clusters[order[i]], &clusters[order[j]]
+		if a.MaxFreq != b.MaxFreq {
+			return a.MaxFreq < b.MaxFreq
+		}
+		return a.Cpus.Cpus()[0] < b.Cpus.Cpus()[0]
+	})
+	renumber := make([]int, len(clusters))
+	for newIdx, oldIdx := range order {
+		renumber[oldIdx] = newIdx
+		topology.Clusters = append(topology.Clusters, clusters[oldIdx])
+	}
+	for idx := range topology.Cpus {
+		topology.Cpus[idx].Cluster = renumber[topology.Cpus[idx].Cluster]
+	}
+	return
+}
+
+// AllOnline is every online cpu
+func (topology *Topology) AllOnline() CpuList {
+	return topology.Online
+}
+
+// LittleCluster is the slowest cluster; on a homogeneous device it is
+// every cpu
+func (topology *Topology) LittleCluster() CpuList {
+	if len(topology.Clusters) == 0 {
+		return CpuList{}
+	}
+	return topology.Clusters[0].Cpus
+}
+
+// BigCluster is the fastest cluster
+func (topology *Topology) BigCluster() CpuList {
+	if len(topology.Clusters) == 0 {
+		return CpuList{}
+	}
+	return topology.Clusters[len(topology.Clusters)-1].Cpus
+}
+
+// SlowestCore is the online cpu with the lowest known maximum frequency,
+// preferring the lowest numbered one. Cpus without cpufreq are skipped;
+// if no frequency is known it is the first online cpu of the little
+// cluster.
+func (topology *Topology) SlowestCore() (cpu int, err error) {
+	var slowest *TopologyCpu
+	for idx := range topology.Cpus {
+		c := &topology.Cpus[idx]
+		if !c.Online || c.MaxFreq == 0 {
+			continue
+		}
+		if slowest == nil || c.MaxFreq < slowest.MaxFreq {
+			slowest = c
+		}
+	}
+	if slowest != nil {
+		return slowest.Id, nil
+	}
+	if cpus := topology.LittleCluster().Intersection(topology.Online).Cpus(); len(cpus) > 0 {
+		return cpus[0], nil
+	}
+	if cpus := topology.Online.Cpus(); len(cpus) > 0 {
+		return cpus[0], nil
+	}
+	return -1, fmt.Errorf("No online cpu")
+}
+
+func (topology *Topology) String() string {
+	var clusters []string
+	for _, cluster := range topology.Clusters {
+		clusters = append(clusters, fmt.Sprintf("[%s @%dkHz]", cluster.Cpus.String(), cluster.MaxFreq))
+	}
+	return fmt.Sprintf("online=%s clusters=%s", topology.Online.String(), strings.Join(clusters, " "))
+}
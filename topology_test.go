@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSlowestCore(t *testing.T) {
+	tests := []struct {
+		name   string
+		online string
+		// maxFreq of cpus 0-3 in kHz, "" for no cpufreq
+		maxFreq [4]string
+		want    int
+	}{
+		{"big.LITTLE", "0-3", [4]string{"2800000", "2800000", "1800000", "1800000"}, 2},
+		{"offline little core", "0-1,3", [4]string{"2800000", "2800000", "", "1800000"}, 3},
+		{"cpu without cpufreq", "0-3", [4]string{"", "2800000", "1800000", "1800000"}, 2},
+		{"no cpufreq", "1-3", [4]string{"", "", "", ""}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useMemFS(t, CGROUP_V1)
+			layout := &Settings.Paths
+			mfs := NewMemFS()
+			Fs = mfs
+			mfs.Create(layout.Cpu("possible"), "0-3\n")
+			mfs.Create(layout.Cpu("online"), test.online+"\n")
+			for cpu, freq := range test.maxFreq {
+				if freq != "" {
+					mfs.Create(layout.CpuFile(cpu, "cpufreq/cpuinfo_max_freq"), freq+"\n")
+				}
+				mfs.Create(layout.CpuFile(cpu, "topology/physical_package_id"), fmt.Sprint(cpu/2))
+			}
+			topology, err := DiscoverTopology()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cpu, err := topology.SlowestCore(); err != nil || cpu != test.want {
+				t.Fatalf("SlowestCore() = %d, %v, want %d (%v)", cpu, err, test.want, topology)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/* Transaction groups cgroup changes that must apply together. Each change
+ * records how to undo itself; Abort undoes them in reverse order so that a
+ * failure half way leaves the cgroups as they were before the transaction.
+ *
+ *   tx := NewTransaction("block")
+ *   if err = tx.Write(file, "0"); err != nil {
+ *           return tx.Abort(err)
+ *   }
+ *   tx.Commit()
+ */
+type Transaction struct {
+	Name string
+	undo []txUndo
+}
+
+type txUndo struct {
+	desc   string
+	revert func() error
+}
+
+func NewTransaction(name string) *Transaction {
+	return &Transaction{Name: name}
+}
+
+// TransactionError is returned by Abort. It unwraps to the error that
+// caused the abort.
+type TransactionError struct {
+	Name string
+	Err  error
+	// RollbackErr is the first error hit while undoing; nil if every
+	// change was undone
+	RollbackErr error
+}
+
+func (e *TransactionError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("%s: %v (rollback failed: %v)", e.Name, e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("%s: %v (rolled back)", e.Name, e.Err)
+}
+
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransactionError) RolledBack() bool {
+	return e.RollbackErr == nil
+}
+
+// Write writes data to a control file such as cpuset.cpus, remembering the
+// previous contents
+func (tx *Transaction) Write(path string, data interface{}) (err error) {
+	var old []byte
+	if old, err = Fs.ReadFile(path); err != nil {
+		return
+	}
+	if err = write(path, data); err != nil {
+		return
+	}
+	previous := strings.TrimSpace(string(old))
+	tx.undo = append(tx.undo, txUndo{
+		desc:   fmt.Sprintf("restore '%s' to %s", previous, path),
+		revert: func() error { return write(path, previous) },
+	})
+	return
+}
+
+/* MigrateTasks moves every tid listed in from into the tasks file to. A
+ * tasks file only lists members, so each tid's cpuset is read from
+ * /proc/<tid>/cpuset first and Abort moves the tid back there.
+ *
+ * Tids that exit while being moved are skipped; any other failure stops
+ * the migration and the tids moved so far are undone by Abort.
+ */
+func (tx *Transaction) MigrateTasks(from string, to string) (err error) {
+	var b []byte
+	if DryRun {
+		return migrateTasks(from, to)
+	}
+	if b, err = Fs.ReadFile(from); err != nil {
+		return
+	}
+	moved := 0
+	for _, field := range strings.Fields(string(b)) {
+		var tid int
+		var restore string
+		if tid, err = strconv.Atoi(field); err != nil {
+			return fmt.Errorf("Bad tid '%s' in %s", field, from)
+		}
+		if restore, err = cpusetTasksOf(tid); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("Failed to read the cpuset of tid %d: %w", tid, err)
+		}
+		// cgroups take one pid per write
+		if err = Fs.WriteFile(to, []byte(field)); err != nil {
+			if errors.Is(err, syscall.ESRCH) {
+				continue
+			}
+			return fmt.Errorf("Failed to move tid %d to %s: %w", tid, to, err)
+		}
+		moved++
+		tx.undo = append(tx.undo, txUndo{
+			desc: fmt.Sprintf("move tid %d back to %s", tid, restore),
+			revert: func() error {
+				if err := Fs.WriteFile(restore, []byte(strconv.Itoa(tid))); err != nil && !errors.Is(err, syscall.ESRCH) {
+					return err
+				}
+				return nil
+			},
+		})
+	}
+	log(fmt.Sprintf("cat %s > %s (Moved: %d tasks)", from, to, moved))
+	return nil
+}
+
+// cpusetTasksOf is the tasks file of the cpuset tid is in
+func cpusetTasksOf(tid int) (tasksFile string, err error) {
+	var b []byte
+	if b, err = Fs.ReadFile(Settings.Paths.Proc(filepath.Join(strconv.Itoa(tid), "cpuset"))); err != nil {
+		return
+	}
+	dir := filepath.Join(Cgroups.Cpuset(CPUSET_DEFAULT), strings.TrimSpace(string(b)))
+	return filepath.Join(dir, groupTasksFile(dir)), nil
+}
+
+// Commit keeps every change made so far
+func (tx *Transaction) Commit() {
+	log(fmt.Sprintf("%s: committed %d changes", tx.Name, len(tx.undo)))
+	tx.undo = nil
+}
+
+// Abort undoes every change in reverse order and returns cause wrapped in a
+// TransactionError. Undo keeps going past errors so that as much as
+// possible is restored.
+func (tx *Transaction) Abort(cause error) error {
+	txErr := &TransactionError{Name: tx.Name, Err: cause}
+	log(fmt.Sprintf("%s: %v; rolling back %d changes", tx.Name, cause, len(tx.undo)))
+	for idx := len(tx.undo) - 1; idx >= 0; idx-- {
+		u := tx.undo[idx]
+		if err := u.revert(); err != nil {
+			log(fmt.Sprintf("%s: failed to %s: %v", tx.Name, u.desc, err))
+			if txErr.RollbackErr == nil {
+				txErr.RollbackErr = err
+			}
+		}
+	}
+	tx.undo = nil
+	return txErr
+}
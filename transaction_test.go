@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestTransactionMigrateTasksAbort(t *testing.T) {
+	mfs := useMemFS(t, CGROUP_V1)
+	oldCgroups := Cgroups
+	t.Cleanup(func() { Cgroups = oldCgroups })
+	Cgroups = CgroupV1{}
+	for _, cpuset := range []string{CgroupCpuset(BG_CGROUP), CgroupCpuset(FG_BG_CGROUP)} {
+		Fs.WriteFile(Cgroups.CpusetFile(cpuset, CPUSET_CPUS), []byte("0"))
+		Fs.WriteFile(Cgroups.CpusetFile(cpuset, CPUSET_MEMS), []byte("0"))
+	}
+	rootTasks := Cgroups.CpusetTasks(CPUSET_DEFAULT)
+	bgTasks := Cgroups.CpusetTasks(CgroupCpuset(BG_CGROUP))
+	fgBgTasks := Cgroups.CpusetTasks(CgroupCpuset(FG_BG_CGROUP))
+	bgCgroupTasks := Cgroups.CgroupTasks(BG_CGROUP)
+
+	// 10 is in the root cpuset and 11 in fg_bg; both are in the bg cgroup
+	mfs.AddPid(10)
+	mfs.AddPid(11)
+	for _, write := range [][2]string{{bgCgroupTasks, "10"}, {bgCgroupTasks, "11"}, {fgBgTasks, "11"}} {
+		if err := Fs.WriteFile(write[0], []byte(write[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx := NewTransaction("test")
+	if err := tx.MigrateTasks(bgCgroupTasks, bgTasks); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, bgTasks); got != "10\n11\n" {
+		t.Fatalf("bg cpuset tasks = %q", got)
+	}
+
+	err := tx.Abort(syscall.EIO)
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) || !txErr.RolledBack() || !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Abort = %v, want a rolled back EIO", err)
+	}
+	if got := readString(t, rootTasks); got != "10\n" {
+		t.Fatalf("root cpuset tasks = %q, want 10 back", got)
+	}
+	if got := readString(t, fgBgTasks); got != "11\n" {
+		t.Fatalf("fg_bg cpuset tasks = %q, want 11 back", got)
+	}
+}
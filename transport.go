@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	TRANSPORT_NETLINK = "netlink"
+	TRANSPORT_UNIX    = "unix"
+	TRANSPORT_GENL    = "genl"
+)
+
+var Transports = []string{TRANSPORT_NETLINK, TRANSPORT_UNIX, TRANSPORT_GENL}
+
+// NewTransport opens the transport of the given kind
+func NewTransport(kind string) (transport SocketInterface, err error) {
+	switch kind {
+	case TRANSPORT_NETLINK:
+		var nl *NetlinkSocket
+		if nl, err = NewNetlinkSocket(Settings.Netlink); err != nil {
+			log("Failed to open netlink socket:", err)
+			return
+		}
+		transport = nl
+	case TRANSPORT_UNIX:
+		var us *UnixSocket
+		if us, err = NewUnixSocket(UnixSocketPath, UnixPeerPath); err != nil {
+			log(fmt.Sprintf("Failed to open unix socket '%s': %v", UnixSocketPath, err))
+			return
+		}
+		transport = us
+	case TRANSPORT_GENL:
+		var gs *GenlSocket
+		if gs, err = NewGenlSocket(GenlFamilyName); err != nil {
+			log(fmt.Sprintf("Failed to open genl family '%s': %v", GenlFamilyName, err))
+			return
+		}
+		transport = gs
+	default:
+		err = fmt.Errorf("Unknown transport: %s", kind)
+	}
+	return
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	UnixSocketPath = "/tmp/thermaplan.sock"
+	UnixPeerPath   = "/tmp/thermaplan-kernel.sock"
+)
+
+// UnixSocket speaks the same netlink framing as NetlinkSocket over a Unix
+// datagram socket. It lets the daemon run against a simulated kernel peer
+// on machines without the patched kernel.
+type UnixSocket struct {
+	Fd   int
+	Path string
+	Peer syscall.SockaddrUnix
+}
+
+func (us *UnixSocket) Send(m *Message) error {
+	msg := *m
+	if msg.Pid == 0 {
+		msg.Pid = uint32(os.Getpid())
+	}
+	pktBytes, err := msg.Marshal(Codec)
+	if err != nil {
+		return err
+	}
+	return syscall.Sendto(us.Fd, pktBytes, 0, &us.Peer)
+}
+
+func (us *UnixSocket) Recv() (messages []syscall.NetlinkMessage, peer *Peer, err error) {
+	return recvNetlinkMessages(us.Fd)
+}
+
+// Close leaves the socket file in place: after a reconnect it belongs to
+// the new socket. NewUnixSocket removes stale ones before binding.
+func (us *UnixSocket) Close() (err error) {
+	err = syscall.Close(us.Fd)
+	us.Fd = -1
+	return
+}
+
+func NewUnixSocket(path string, peer string) (us *UnixSocket, err error) {
+	var fd int
+	if fd, err = syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0); err != nil {
+		return
+	}
+	// A previous run may have left the socket file behind
+	syscall.Unlink(path)
+	if err = syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		syscall.Close(fd)
+		return
+	}
+	if err = setRecvTimeout(fd, RECV_POLL_INTERVAL); err != nil {
+		syscall.Close(fd)
+		return
+	}
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1); err != nil {
+		syscall.Close(fd)
+		return
+	}
+	us = new(UnixSocket)
+	us.Fd = fd
+	us.Path = path
+	us.Peer.Name = peer
+	return
+}